@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Delays between retries of failed Accept.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+func nextAcceptDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return minAcceptDelay
+	}
+	delay *= 2
+	if delay > maxAcceptDelay {
+		delay = maxAcceptDelay
+	}
+	return delay
+}
+
+// startWorkers runs workers processing connections from the queue
+// until it is closed.
+func (t *TLSProxy) startWorkers() chan net.Conn {
+	queue := make(chan net.Conn, t.queueDepth)
+	for i := 0; i < t.workers; i++ {
+		go func() {
+			for conn := range queue {
+				t.ProcessRequest(conn)
+			}
+		}()
+	}
+	return queue
+}
+
+// enqueue passes connection to workers or closes it if the queue is full.
+func (t *TLSProxy) enqueue(queue chan net.Conn, conn net.Conn) {
+	select {
+	case queue <- conn:
+	default:
+		shed := atomic.AddInt64(&t.shed, 1)
+		log.Printf("Queue is full, dropping connection from %s (%d dropped)", conn.RemoteAddr(), shed)
+		conn.Close()
+	}
+}
+
+// Shed returns number of connections dropped because the queue was full.
+func (t *TLSProxy) Shed() int64 {
+	return atomic.LoadInt64(&t.shed)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// FailingListener fails Accept with errno several times,
+// then with final error.
+type FailingListener struct {
+	net.Listener
+	errno    syscall.Errno
+	failures int
+	final    error
+	calls    int
+}
+
+func (l *FailingListener) Accept() (net.Conn, error) {
+	l.calls++
+	if l.calls <= l.failures {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", l.errno)}
+	}
+	return nil, l.final
+}
+
+func TestNextAcceptDelay(t *testing.T) {
+	var delays []time.Duration
+	var delay time.Duration
+	for i := 0; i < 10; i++ {
+		delay = nextAcceptDelay(delay)
+		delays = append(delays, delay)
+	}
+	if delays[0] != minAcceptDelay || delays[1] != 2*minAcceptDelay || delays[9] != maxAcceptDelay {
+		t.Errorf("Got delays %v", delays)
+	}
+}
+
+func TestStartBacksOffAndStops(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+	failing := &FailingListener{Listener: listener, errno: syscall.EMFILE, failures: 4, final: net.ErrClosed}
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.listener = failing
+	started := time.Now()
+	proxy.Start()
+	elapsed := time.Since(started)
+	if failing.calls != 5 {
+		t.Errorf("Accept was called %d times, expected 5", failing.calls)
+	}
+	if want := 15 * minAcceptDelay; elapsed < want {
+		t.Errorf("Retries took %s, expected at least %s", elapsed, want)
+	}
+}
+
+func TestStartRetriesAnyError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+	failing := &FailingListener{Listener: listener, errno: syscall.ENOBUFS, failures: 2, final: net.ErrClosed}
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.listener = failing
+	proxy.Start()
+	if failing.calls != 3 {
+		t.Errorf("Accept was called %d times, expected 3", failing.calls)
+	}
+}
+
+func TestStartReturnsWhenListenerClosed(t *testing.T) {
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.Listen("tcp", "127.0.0.1:0")
+	proxy.workers = 2
+	stopped := make(chan bool)
+	go func() {
+		proxy.Start()
+		stopped <- true
+	}()
+	proxy.listener.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Start did not return after listener was closed")
+	}
+}
+
+// BlockingSNIParser reports connections and waits until released.
+type BlockingSNIParser struct {
+	started chan bool
+	release chan bool
+}
+
+func (p BlockingSNIParser) ServerNameFromConn(clientConn net.Conn) (string, net.Conn, error) {
+	p.started <- true
+	<-p.release
+	return "", nil, errors.New("released")
+}
+
+func TestWorkersShedLoad(t *testing.T) {
+	parser := BlockingSNIParser{started: make(chan bool, 10), release: make(chan bool)}
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.sniParser = parser
+	proxy.workers = 1
+	proxy.queueDepth = 1
+	proxy.Listen("tcp", "127.0.0.1:0")
+	defer proxy.listener.Close()
+	go proxy.Start()
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %s", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		if i == 0 {
+			// wait until the worker is busy
+			<-parser.started
+		}
+	}
+	// the third connection is dropped: the worker is busy
+	// and the second connection fills the queue
+	conns[2].SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conns[2].Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("Third connection was not closed: %v", err)
+	}
+	if proxy.Shed() != 1 {
+		t.Errorf("Shed %d connections, expected 1", proxy.Shed())
+	}
+	select {
+	case <-parser.started:
+		t.Errorf("Queued connection was processed while the worker was busy")
+	default:
+	}
+	parser.release <- true
+	select {
+	case <-parser.started:
+	case <-time.After(time.Second):
+		t.Errorf("Queued connection was not processed")
+	}
+	parser.release <- true
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
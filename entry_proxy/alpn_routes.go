@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ALPNRoute sends connections offering Protocol to another port
+// and/or another onion. Host is "*" for all hosts, a hostname or
+// "*.example.com" for all subdomains.
+type ALPNRoute struct {
+	Host     string
+	Protocol string
+	Onion    string // "" to keep the resolved onion
+	Port     int    // 0 to keep the resolved port
+	Source   string // where the route comes from, for logging
+}
+
+func (r ALPNRoute) String() string {
+	return fmt.Sprintf("%s %s %s:%d (%s)", r.Host, r.Protocol, r.Onion, r.Port, r.Source)
+}
+
+func parseALPNPort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("bad port %q", s)
+	}
+	return port, nil
+}
+
+// ParseALPNRoute parses route "<host> <protocol> <port|onion|onion:port>".
+func ParseALPNRoute(line, source string) (ALPNRoute, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return ALPNRoute{}, fmt.Errorf("%s: expected 3 fields in route %q", source, line)
+	}
+	route := ALPNRoute{Host: fields[0], Protocol: fields[1], Source: source}
+	if route.Host != "*" {
+		prefix := ""
+		host := route.Host
+		if strings.HasPrefix(host, "*.") {
+			prefix = "*."
+			host = host[len(prefix):]
+		}
+		host, err := NormalizeHostname(host)
+		if err != nil {
+			return route, fmt.Errorf("%s: %s", source, err)
+		}
+		route.Host = prefix + host
+	}
+	destination := strings.ToLower(fields[2])
+	var err error
+	if onionRegexp.MatchString(destination) {
+		route.Onion = destination
+	} else if host, port, splitErr := net.SplitHostPort(destination); splitErr == nil {
+		if !onionRegexp.MatchString(host) {
+			return route, fmt.Errorf("%s: bad onion address %q", source, host)
+		}
+		route.Onion = host
+		route.Port, err = parseALPNPort(port)
+	} else {
+		route.Port, err = parseALPNPort(destination)
+	}
+	if err != nil {
+		return route, fmt.Errorf("%s: %s", source, err)
+	}
+	return route, nil
+}
+
+// LoadALPNRoutes reads routes from file, one route per line.
+// Empty lines and lines starting with "#" are ignored.
+func LoadALPNRoutes(filename string) (*ALPNRouter, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var routes []ALPNRoute
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", filename, lineNumber)
+		route, err := ParseALPNRoute(line, source)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &ALPNRouter{routes: routes}, nil
+}
+
+// ALPNRouter selects route by protocols offered by the client.
+type ALPNRouter struct {
+	routes []ALPNRoute
+}
+
+// find returns route for the first protocol of the client having one.
+// Routes of the host win over global routes.
+func (r *ALPNRouter) find(hostname string, protocols []string) *ALPNRoute {
+	for _, protocol := range protocols {
+		var global *ALPNRoute
+		for i := range r.routes {
+			route := &r.routes[i]
+			if route.Protocol != protocol {
+				continue
+			}
+			if route.Host == "*" {
+				if global == nil {
+					global = route
+				}
+			} else if claimMatches(route.Host, hostname) {
+				return route
+			}
+		}
+		if global != nil {
+			return global
+		}
+	}
+	return nil
+}
+
+// Apply rewrites resolved targets according to the route matching
+// hostname and protocols. Targets are returned unchanged if no route matches.
+func (r *ALPNRouter) Apply(hostname string, protocols []string, targets []OnionTarget) []OnionTarget {
+	route := r.find(hostname, protocols)
+	if route == nil {
+		return targets
+	}
+	log.Printf("%s: protocol %s is routed by %s", hostname, route.Protocol, route)
+	if route.Onion != "" {
+		target := OnionTarget{Onion: route.Onion, Port: route.Port}
+		if len(targets) != 0 {
+			target.Isolation = targets[0].Isolation
+		}
+		return []OnionTarget{target}
+	}
+	routed := make([]OnionTarget, len(targets))
+	for i, target := range targets {
+		target.Port = route.Port
+		routed[i] = target
+	}
+	return routed
+}
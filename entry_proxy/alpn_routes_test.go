@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseALPNRoute(t *testing.T) {
+	for line, want := range map[string]ALPNRoute{
+		"* h2 8443":                  {Host: "*", Protocol: "h2", Port: 8443},
+		"Pasta.cf. xmpp-client 5222": {Host: "pasta.cf", Protocol: "xmpp-client", Port: 5222},
+		"*.pasta.cf acme-tls/1 t3mny6lhnyku4wrd.onion": {
+			Host:     "*.pasta.cf",
+			Protocol: "acme-tls/1",
+			Onion:    "t3mny6lhnyku4wrd.onion",
+		},
+		"* http/1.1 T3MNY6LHNYKU4WRD.onion:8080": {
+			Host:     "*",
+			Protocol: "http/1.1",
+			Onion:    "t3mny6lhnyku4wrd.onion",
+			Port:     8080,
+		},
+	} {
+		route, err := ParseALPNRoute(line, "test")
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", line, err)
+			continue
+		}
+		want.Source = "test"
+		if route != want {
+			t.Errorf("Parsed %q as %v, expected %v", line, route, want)
+		}
+	}
+	for _, line := range []string{
+		"* h2",
+		"* h2 8443 extra",
+		"* h2 0",
+		"* h2 65536",
+		"* h2 example.com:443",
+		"* h2 t3mny6lhnyku4wrd.onion:port",
+		"bad_host! h2 443",
+	} {
+		if _, err := ParseALPNRoute(line, "test"); err == nil {
+			t.Errorf("Expected error for %q", line)
+		}
+	}
+}
+
+func makeALPNRouter(t *testing.T, lines ...string) *ALPNRouter {
+	router := &ALPNRouter{}
+	for _, line := range lines {
+		route, err := ParseALPNRoute(line, "test")
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %s", line, err)
+		}
+		router.routes = append(router.routes, route)
+	}
+	return router
+}
+
+func TestALPNRouterApply(t *testing.T) {
+	router := makeALPNRouter(t,
+		"* h2 8443",
+		"pasta.cf h2 9443",
+		"*.pasta.cf xmpp-client t3mny6lhnyku4wrd.onion:5222",
+		"* acme-tls/1 t3mny6lhnyku4wrd.onion",
+	)
+	resolved := []OnionTarget{
+		{Onion: "pastagdsp33j7aoq.onion", Isolation: "pasta"},
+		{Onion: "pastagdsp33j7aoq.onion", Port: 4443},
+	}
+	for _, c := range []struct {
+		host      string
+		protocols []string
+		want      []OnionTarget
+	}{
+		{"pasta.cf", nil, resolved},
+		{"pasta.cf", []string{"spdy/3"}, resolved},
+		{"example.com", []string{"h2", "http/1.1"}, []OnionTarget{
+			{Onion: "pastagdsp33j7aoq.onion", Port: 8443, Isolation: "pasta"},
+			{Onion: "pastagdsp33j7aoq.onion", Port: 8443},
+		}},
+		{"pasta.cf", []string{"spdy/3", "h2"}, []OnionTarget{
+			{Onion: "pastagdsp33j7aoq.onion", Port: 9443, Isolation: "pasta"},
+			{Onion: "pastagdsp33j7aoq.onion", Port: 9443},
+		}},
+		{"chat.pasta.cf", []string{"xmpp-client"}, []OnionTarget{
+			{Onion: "t3mny6lhnyku4wrd.onion", Port: 5222, Isolation: "pasta"},
+		}},
+		{"pasta.cf", []string{"xmpp-client"}, resolved},
+		{"example.com", []string{"acme-tls/1"}, []OnionTarget{
+			{Onion: "t3mny6lhnyku4wrd.onion", Isolation: "pasta"},
+		}},
+	} {
+		got := router.Apply(c.host, c.protocols, resolved)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %v: got %v, expected %v", c.host, c.protocols, got, c.want)
+		}
+	}
+}
+
+func TestLoadALPNRoutes(t *testing.T) {
+	filename := writePolicyFile(t, "# routes\n\n* h2 8443\n")
+	defer os.Remove(filename)
+	router, err := LoadALPNRoutes(filename)
+	if err != nil {
+		t.Fatalf("Failed to load routes: %s", err)
+	}
+	if len(router.routes) != 1 || router.routes[0].Source != filename+":3" {
+		t.Errorf("Got routes %v", router.routes)
+	}
+	filename = writePolicyFile(t, "* h2 8443\n* h2\n")
+	defer os.Remove(filename)
+	if _, err := LoadALPNRoutes(filename); err == nil {
+		t.Errorf("Expected error for bad route")
+	}
+}
+
+// RecordingDialer reports targets and fails to connect.
+type RecordingDialer chan string
+
+func (d RecordingDialer) Dial(targetServer string) (net.Conn, error) {
+	d <- targetServer
+	return nil, errors.New("not connecting in test")
+}
+
+func TestProxyRoutesByALPN(t *testing.T) {
+	dialer := make(RecordingDialer, 1)
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.dialer = dialer
+	proxy.alpnRouter = makeALPNRouter(t, "example.com xmpp-client t3mny6lhnyku4wrd.onion:5222")
+	proxy.Listen("tcp", "127.0.0.1:0")
+	defer proxy.listener.Close()
+	go proxy.Start()
+	for _, c := range []struct {
+		protocols []string
+		want      string
+	}{
+		{[]string{"xmpp-client"}, "t3mny6lhnyku4wrd.onion:5222"},
+		{[]string{"h2"}, "pastagdsp33j7aoq.onion:443"},
+	} {
+		tls.Dial("tcp", proxy.Addr().String(), &tls.Config{
+			ServerName: "example.com",
+			NextProtos: c.protocols,
+		})
+		if got := <-dialer; got != c.want {
+			t.Errorf("ALPN %v: dialed %s, expected %s", c.protocols, got, c.want)
+		}
+	}
+}
+
+func TestProxyChecksPolicyOfALPNRoutes(t *testing.T) {
+	dialer := make(RecordingDialer, 1)
+	policy, _ := NewPolicy()
+	policy.SetRules("test", []PolicyRule{{Action: "block", Kind: "onion", Pattern: "t3mny6lhnyku4wrd.onion"}})
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.dialer = dialer
+	proxy.policy = policy
+	proxy.alpnRouter = makeALPNRouter(t, "example.com xmpp-client t3mny6lhnyku4wrd.onion:5222")
+	proxy.Listen("tcp", "127.0.0.1:0")
+	defer proxy.listener.Close()
+	go proxy.Start()
+	_, err := tls.Dial("tcp", proxy.Addr().String(), &tls.Config{
+		ServerName: "example.com",
+		NextProtos: []string{"xmpp-client"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("Expected access denied alert, got %v", err)
+	}
+	select {
+	case got := <-dialer:
+		t.Errorf("Dialed blocked onion %s", got)
+	default:
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"gopkg.in/yaml.v2"
+)
+
+// maxBlocklistSize limits the size of a blocklist feed.
+const maxBlocklistSize = 16 * 1024 * 1024
+
+// BlocklistFeed periodically fetches blocklist from URL and applies it
+// to Policy. The list starts with lines "version <n>" and
+// "expires <unix time>" followed by "block host|onion <pattern>" rules
+// (see ParsePolicyRule). Detached ed25519 signature of the list, base64
+// encoded, is fetched from URL + ".sig" and must be made by one of the
+// publisher keys. Expired lists and lists older than the highest version
+// accepted so far are rejected, so old lists can not be replayed.
+// The highest version survives restarts if state is set.
+type BlocklistFeed struct {
+	url    string
+	keys   []ed25519.PublicKey
+	policy *Policy
+	client *http.Client
+	state  *BlocklistState
+	now    func() time.Time
+
+	mutex   sync.Mutex
+	version int64     // highest version accepted
+	applied bool      // if a list of version is applied
+	expires time.Time // expiry of the applied list
+}
+
+func NewBlocklistFeed(
+	url string,
+	keys []ed25519.PublicKey,
+	policy *Policy,
+	state *BlocklistState,
+	timeout time.Duration,
+) *BlocklistFeed {
+	version := int64(-1)
+	if state != nil {
+		version = state.Version(url)
+	}
+	return &BlocklistFeed{
+		url:     url,
+		keys:    keys,
+		policy:  policy,
+		client:  &http.Client{Timeout: timeout},
+		state:   state,
+		now:     time.Now,
+		version: version,
+	}
+}
+
+// BlocklistState keeps the highest accepted version of each feed in a file.
+type BlocklistState struct {
+	filename string
+
+	mutex    sync.Mutex
+	versions map[string]int64 // URL -> version
+}
+
+// LoadBlocklistState reads state from filename.
+// Missing file is treated as empty state.
+func LoadBlocklistState(filename string) (*BlocklistState, error) {
+	s := &BlocklistState{
+		filename: filename,
+		versions: make(map[string]int64),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &s.versions); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", filename, err)
+	}
+	if s.versions == nil {
+		s.versions = make(map[string]int64)
+	}
+	return s, nil
+}
+
+// Version returns the highest accepted version of the feed or -1.
+func (s *BlocklistState) Version(url string) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if version, ok := s.versions[url]; ok {
+		return version
+	}
+	return -1
+}
+
+// SetVersion records version of the feed and saves the state.
+func (s *BlocklistState) SetVersion(url string, version int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.versions[url] = version
+	data, err := yaml.Marshal(s.versions)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.filename, data)
+}
+
+// ParsePublisherKey decodes base64 ed25519 public key.
+func ParsePublisherKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Bad base64 in publisher key: %s", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Publisher key has %d bytes, expected %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func (f *BlocklistFeed) fetch(url string) ([]byte, error) {
+	response, err := f.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d from %s", response.StatusCode, url)
+	}
+	return ioutil.ReadAll(io.LimitReader(response.Body, maxBlocklistSize))
+}
+
+func (f *BlocklistFeed) verify(list, encodedSignature []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encodedSignature)))
+	if err != nil {
+		return fmt.Errorf("Bad base64 in signature: %s", err)
+	}
+	for _, key := range f.keys {
+		if ed25519.Verify(key, list, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Signature of %s is not made by any publisher key", f.url)
+}
+
+// parseBlocklist returns version, expiry and rules of the list.
+func (f *BlocklistFeed) parseBlocklist(list []byte) (int64, time.Time, []PolicyRule, error) {
+	var version int64 = -1
+	var expires time.Time
+	var rules []PolicyRule
+	scanner := bufio.NewScanner(bytes.NewReader(list))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", f.url, lineNumber)
+		if version == -1 || expires.IsZero() {
+			fields := strings.Fields(line)
+			name := "version"
+			if version != -1 {
+				name = "expires"
+			}
+			if len(fields) != 2 || fields[0] != name {
+				return 0, time.Time{}, nil, fmt.Errorf("%s: expected %s line", source, name)
+			}
+			number, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || number <= 0 {
+				return 0, time.Time{}, nil, fmt.Errorf("%s: bad %s %q", source, name, fields[1])
+			}
+			if version == -1 {
+				version = number
+			} else {
+				expires = time.Unix(number, 0)
+			}
+			continue
+		}
+		rule, err := ParsePolicyRule(line, source)
+		if err != nil {
+			return 0, time.Time{}, nil, err
+		}
+		if rule.Action != "block" {
+			return 0, time.Time{}, nil, fmt.Errorf("%s: only block rules are allowed in feeds", source)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, time.Time{}, nil, err
+	}
+	if expires.IsZero() {
+		return 0, time.Time{}, nil, fmt.Errorf("No version and expiry in %s", f.url)
+	}
+	return version, expires, rules, nil
+}
+
+// Update fetches the list and applies it if it is valid and newer.
+func (f *BlocklistFeed) Update() error {
+	list, err := f.fetch(f.url)
+	if err != nil {
+		return err
+	}
+	signature, err := f.fetch(f.url + ".sig")
+	if err != nil {
+		return err
+	}
+	if err := f.verify(list, signature); err != nil {
+		return err
+	}
+	version, expires, rules, err := f.parseBlocklist(list)
+	if err != nil {
+		return err
+	}
+	if !f.now().Before(expires) {
+		return fmt.Errorf("Blocklist %s version %d expired at %s", f.url, version, expires)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if version < f.version {
+		return fmt.Errorf("Blocklist %s version %d is older than version %d", f.url, version, f.version)
+	}
+	if version == f.version && f.applied {
+		// the publisher may sign the same list again to extend its expiry
+		if expires.After(f.expires) {
+			f.expires = expires
+		}
+		return nil
+	}
+	if f.state != nil && version != f.version {
+		if err := f.state.SetVersion(f.url, version); err != nil {
+			return fmt.Errorf("Unable to save version of blocklist %s: %s", f.url, err)
+		}
+	}
+	f.policy.SetRules(f.url, rules)
+	f.version = version
+	f.applied = true
+	f.expires = expires
+	log.Printf("Applied blocklist %s version %d with %d rules", f.url, version, len(rules))
+	return nil
+}
+
+// Expired returns if the applied list has expired, i.e. no valid list
+// was fetched for too long. Its rules stay applied.
+func (f *BlocklistFeed) Expired() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.applied && !f.now().Before(f.expires)
+}
+
+// Run updates the list every interval, forever.
+func (f *BlocklistFeed) Run(interval time.Duration) {
+	for {
+		if err := f.Update(); err != nil {
+			log.Printf("Unable to update blocklist %s: %s", f.url, err)
+		}
+		if f.Expired() {
+			log.Printf("Warning: blocklist %s has expired, its publisher sends no updates", f.url)
+		}
+		time.Sleep(interval)
+	}
+}
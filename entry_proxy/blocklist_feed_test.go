@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// FeedServer serves blocklist and its signature.
+type FeedServer struct {
+	server    *httptest.Server
+	list      string
+	signature string
+}
+
+func NewFeedServer() *FeedServer {
+	s := &FeedServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blocklist", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(s.list))
+	})
+	mux.HandleFunc("/blocklist.sig", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(s.signature))
+	})
+	s.server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *FeedServer) publish(list string, key ed25519.PrivateKey) {
+	s.list = list
+	s.signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(list)))
+}
+
+// feedExpires is the expiry of lists published in tests.
+var feedExpires = time.Unix(1500000000, 0)
+
+// feedList makes list of given version expiring at feedExpires.
+func feedList(version int, rules string) string {
+	return fmt.Sprintf("version %d\nexpires %d\n%s", version, feedExpires.Unix(), rules)
+}
+
+func makeBlocklistFeed(t *testing.T, state *BlocklistState) (*BlocklistFeed, *Policy, *FeedServer, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	policy, _ := NewPolicy()
+	server := NewFeedServer()
+	feed := NewBlocklistFeed(
+		server.server.URL+"/blocklist",
+		[]ed25519.PublicKey{publicKey},
+		policy,
+		state,
+		time.Second,
+	)
+	feed.now = func() time.Time { return feedExpires.Add(-time.Hour) }
+	return feed, policy, server, privateKey
+}
+
+func TestBlocklistFeed(t *testing.T) {
+	feed, policy, server, key := makeBlocklistFeed(t, nil)
+	defer server.server.Close()
+	server.publish(feedList(2, "block host evil.com\n"), key)
+	if err := feed.Update(); err != nil {
+		t.Fatalf("Failed to update: %s", err)
+	}
+	checkErrorKind(t, "blocked host", policy.Check("host", "evil.com"), PolicyDenied)
+
+	// older version must be rejected
+	server.publish(feedList(1, "block host example.com\n"), key)
+	if err := feed.Update(); err == nil {
+		t.Fatalf("Older list was accepted")
+	}
+	if err := policy.Check("host", "example.com"); err != nil {
+		t.Errorf("Rule from older list was applied")
+	}
+	checkErrorKind(t, "still blocked", policy.Check("host", "evil.com"), PolicyDenied)
+
+	server.publish(feedList(3, "block onion pastagdsp33j7aoq.onion\n"), key)
+	if err := feed.Update(); err != nil {
+		t.Fatalf("Failed to update: %s", err)
+	}
+	if err := policy.Check("host", "evil.com"); err != nil {
+		t.Errorf("Rule from replaced list is still applied")
+	}
+	checkErrorKind(t, "blocked onion", policy.Check("onion", "pastagdsp33j7aoq.onion"), PolicyDenied)
+}
+
+func TestBlocklistFeedRejected(t *testing.T) {
+	feed, policy, server, key := makeBlocklistFeed(t, nil)
+	defer server.server.Close()
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	for name, publish := range map[string]func(){
+		"other key": func() {
+			server.publish(feedList(1, "block host evil.com\n"), otherKey)
+		},
+		"tampered": func() {
+			server.publish(feedList(1, "block host example.com\n"), key)
+			server.list = feedList(1, "block host evil.com\n")
+		},
+		"no version": func() {
+			server.publish("block host evil.com\n", key)
+		},
+		"no expiry": func() {
+			server.publish("version 1\nblock host evil.com\n", key)
+		},
+		"expired": func() {
+			list := fmt.Sprintf("version 1\nexpires %d\nblock host evil.com\n", feedExpires.Add(-2*time.Hour).Unix())
+			server.publish(list, key)
+		},
+		"allow rule": func() {
+			server.publish(feedList(1, "block host evil.com\nallow host evil.com\n"), key)
+		},
+		"bad signature encoding": func() {
+			server.publish(feedList(1, "block host evil.com\n"), key)
+			server.signature = "!!!"
+		},
+	} {
+		publish()
+		if err := feed.Update(); err == nil {
+			t.Errorf("Case %q was accepted", name)
+		}
+		if err := policy.Check("host", "evil.com"); err != nil {
+			t.Errorf("Case %q changed policy", name)
+		}
+	}
+}
+
+func TestBlocklistFeedState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocklist")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.yaml")
+	state, err := LoadBlocklistState(filename)
+	if err != nil {
+		t.Fatalf("Failed to load state: %s", err)
+	}
+	feed, _, server, key := makeBlocklistFeed(t, state)
+	defer server.server.Close()
+	server.publish(feedList(2, "block host evil.com\n"), key)
+	if err := feed.Update(); err != nil {
+		t.Fatalf("Failed to update: %s", err)
+	}
+
+	// after restart, the same version is applied again
+	// and older versions are rejected
+	state, err = LoadBlocklistState(filename)
+	if err != nil {
+		t.Fatalf("Failed to reload state: %s", err)
+	}
+	if version := state.Version(feed.url); version != 2 {
+		t.Fatalf("Saved version %d, expected 2", version)
+	}
+	policy, _ := NewPolicy()
+	restarted := NewBlocklistFeed(feed.url, feed.keys, policy, state, time.Second)
+	restarted.now = feed.now
+	server.publish(feedList(1, "block host example.com\n"), key)
+	if err := restarted.Update(); err == nil {
+		t.Fatalf("Older list was accepted after restart")
+	}
+	server.publish(feedList(2, "block host evil.com\n"), key)
+	if err := restarted.Update(); err != nil {
+		t.Fatalf("Failed to update after restart: %s", err)
+	}
+	checkErrorKind(t, "blocked host", policy.Check("host", "evil.com"), PolicyDenied)
+}
+
+func TestBlocklistFeedExpired(t *testing.T) {
+	feed, _, server, key := makeBlocklistFeed(t, nil)
+	defer server.server.Close()
+	server.publish(feedList(1, "block host evil.com\n"), key)
+	if err := feed.Update(); err != nil {
+		t.Fatalf("Failed to update: %s", err)
+	}
+	if feed.Expired() {
+		t.Fatalf("Fresh list has expired")
+	}
+	feed.now = func() time.Time { return feedExpires }
+	if !feed.Expired() {
+		t.Fatalf("Withheld updates were not noticed")
+	}
+}
+
+func TestParsePublisherKey(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, err := ParsePublisherKey(base64.StdEncoding.EncodeToString(publicKey))
+	if err != nil || string(key) != string(publicKey) {
+		t.Fatalf("Failed to parse key: %s", err)
+	}
+	if _, err := ParsePublisherKey("c2hvcnQ="); err == nil {
+		t.Fatalf("Short key was accepted")
+	}
+}
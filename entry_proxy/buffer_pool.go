@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// DefaultBufferSize is the size of copy buffers, same as of io.Copy.
+const DefaultBufferSize = 32 * 1024
+
+// smallBufferSize is the size of the buffer each stream owns.
+// It is used while the stream is idle or slow.
+const smallBufferSize = 512
+
+// BufferPool shares copy buffers between streams. If budget is not 0,
+// total size of buffers in use, small buffers of streams included, is
+// limited: when it is exhausted, streams get no large buffers and keep
+// copying through their small buffers. The budget is a soft cap: small
+// buffers are taken even over it, since a stream can not make progress
+// without one. Pausing reads until the budget allows instead could
+// deadlock the two directions of a connection.
+type BufferPool struct {
+	size   int
+	budget int64
+	pool   sync.Pool
+	small  sync.Pool
+
+	mutex sync.Mutex
+	inUse int64 // bytes of buffers taken
+	large int   // number of buffers taken by Get
+}
+
+func NewBufferPool(size int, budget int64) *BufferPool {
+	p := &BufferPool{
+		size:   size,
+		budget: budget,
+	}
+	p.pool.New = func() interface{} {
+		buffer := make([]byte, size)
+		return &buffer
+	}
+	p.small.New = func() interface{} {
+		buffer := make([]byte, smallBufferSize)
+		return &buffer
+	}
+	return p
+}
+
+// Get takes buffer from the pool, or returns nil if the budget is
+// exhausted. One buffer is always allowed, so a budget smaller than
+// the size of a buffer still lets one stream use it.
+func (p *BufferPool) Get() *[]byte {
+	if p.budget > 0 {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if p.large > 0 && p.inUse+int64(p.size) > p.budget {
+			return nil
+		}
+		p.large++
+		p.inUse += int64(p.size)
+	}
+	return p.pool.Get().(*[]byte)
+}
+
+// Put returns buffer taken by Get.
+func (p *BufferPool) Put(buffer *[]byte) {
+	p.pool.Put(buffer)
+	if p.budget > 0 {
+		p.mutex.Lock()
+		p.large--
+		p.inUse -= int64(p.size)
+		p.mutex.Unlock()
+	}
+}
+
+// getSmall takes small buffer of a stream. It is counted against the
+// budget but never refused.
+func (p *BufferPool) getSmall() *[]byte {
+	if p.budget > 0 {
+		p.mutex.Lock()
+		p.inUse += smallBufferSize
+		p.mutex.Unlock()
+	}
+	return p.small.Get().(*[]byte)
+}
+
+// putSmall returns buffer taken by getSmall.
+func (p *BufferPool) putSmall(buffer *[]byte) {
+	p.small.Put(buffer)
+	if p.budget > 0 {
+		p.mutex.Lock()
+		p.inUse -= smallBufferSize
+		p.mutex.Unlock()
+	}
+}
+
+// InUse returns total size of buffers taken from the pool.
+func (p *BufferPool) InUse() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.inUse
+}
+
+// Copy copies src to dst until EOF like io.Copy. When data can be spliced,
+// no buffer is used. Otherwise the stream reads into its small buffer and
+// takes a large one when a read fills the small buffer (if the budget
+// allows), returning it as soon as a read is not full. So idle streams
+// hold only their small buffers.
+func (p *BufferPool) Copy(dst, src net.Conn) (int64, error) {
+	if canSplice(dst, src) {
+		return io.Copy(dst, src)
+	}
+	smallBuffer := p.getSmall()
+	defer p.putSmall(smallBuffer)
+	small := *smallBuffer
+	var large *[]byte
+	defer func() {
+		if large != nil {
+			p.Put(large)
+		}
+	}()
+	var written int64
+	for {
+		buffer := small
+		if large != nil {
+			buffer = *large
+		}
+		n, err := src.Read(buffer)
+		if n > 0 {
+			m, writeErr := dst.Write(buffer[:n])
+			written += int64(m)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if m != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		if large == nil && n == len(buffer) {
+			large = p.Get()
+		} else if large != nil && n < len(buffer) {
+			p.Put(large)
+			large = nil
+		}
+	}
+}
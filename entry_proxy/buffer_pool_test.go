@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBufferPoolBudget(t *testing.T) {
+	pool := NewBufferPool(1024, 2048)
+	first := pool.Get()
+	second := pool.Get()
+	if len(*first) != 1024 || pool.InUse() != 2048 {
+		t.Fatalf("Got buffer of %d bytes, %d in use", len(*first), pool.InUse())
+	}
+	if third := pool.Get(); third != nil {
+		t.Fatalf("Got buffer over budget")
+	}
+	pool.Put(first)
+	third := pool.Get()
+	if third == nil {
+		t.Fatalf("No buffer after Put")
+	}
+	pool.Put(third)
+	pool.Put(second)
+	if pool.InUse() != 0 {
+		t.Errorf("%d bytes still in use", pool.InUse())
+	}
+}
+
+func TestBufferPoolBudgetCountsSmallBuffers(t *testing.T) {
+	pool := NewBufferPool(1024, 2048)
+	small := pool.getSmall()
+	first := pool.Get()
+	if second := pool.Get(); second != nil {
+		t.Fatalf("Got buffer over budget taken by small buffer")
+	}
+	// small buffers are taken over the budget
+	smallOver := pool.getSmall()
+	if pool.InUse() != 1024+2*smallBufferSize {
+		t.Errorf("%d bytes in use, expected %d", pool.InUse(), 1024+2*smallBufferSize)
+	}
+	pool.putSmall(smallOver)
+	pool.putSmall(small)
+	pool.Put(first)
+	if pool.InUse() != 0 {
+		t.Errorf("%d bytes still in use", pool.InUse())
+	}
+}
+
+func TestBufferPoolBudgetSmallerThanBuffer(t *testing.T) {
+	pool := NewBufferPool(1024, 100)
+	buffer := pool.Get()
+	if buffer == nil {
+		t.Fatalf("No buffer within budget smaller than buffer")
+	}
+	pool.Put(buffer)
+}
+
+// TestBufferPoolBidirectional proxies to echo server, which writes back
+// each chunk before reading the next one, with budget of one buffer.
+// The direction which does not get the buffer must not wait for it.
+func TestBufferPoolBidirectional(t *testing.T) {
+	pool := NewBufferPool(4096, 4096)
+	client, proxyClient := net.Pipe()
+	proxyServer, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		io.CopyBuffer(server, server, make([]byte, 8192))
+	}()
+	go pipe(proxyClient, proxyServer, pool)
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	go func() {
+		client.Write(data)
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("Failed to read echo: %s", err)
+	}
+	client.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("Echo differs from sent data")
+	}
+}
+
+func TestBufferPoolCopy(t *testing.T) {
+	pool := NewBufferPool(4096, 0)
+	pool.budget = 1 << 20 // to count buffers in use
+	srcClient, srcServer := net.Pipe()
+	dstClient, dstServer := net.Pipe()
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Copy(dstServer, srcServer)
+		dstServer.Close()
+		done <- err
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := ioutil.ReadAll(dstClient)
+		received <- data
+	}()
+	srcClient.Write(data)
+	// the stream is idle now
+	for i := 0; pool.InUse() != smallBufferSize; i++ {
+		if i == 100 {
+			t.Fatalf("Idle stream holds %d bytes of buffers", pool.InUse())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srcClient.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Copy failed: %s", err)
+	}
+	if pool.InUse() != 0 {
+		t.Errorf("%d bytes still in use after Copy", pool.InUse())
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Errorf("Got %d bytes, expected %d", len(got), len(data))
+	}
+}
+
+// benchmarkCopy copies 1MB through pipes b.N times with copy function.
+func benchmarkCopy(b *testing.B, copy func(dst, src net.Conn) (int64, error)) {
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		srcClient, srcServer := net.Pipe()
+		dstClient, dstServer := net.Pipe()
+		go func() {
+			srcClient.Write(data)
+			srcClient.Close()
+		}()
+		go func() {
+			copy(dstServer, srcServer)
+			dstServer.Close()
+		}()
+		io.Copy(ioutil.Discard, dstClient)
+	}
+}
+
+func BenchmarkCopyPooled(b *testing.B) {
+	pool := NewBufferPool(DefaultBufferSize, 0)
+	benchmarkCopy(b, pool.Copy)
+}
+
+func BenchmarkCopyIoCopy(b *testing.B) {
+	benchmarkCopy(b, func(dst, src net.Conn) (int64, error) {
+		return io.Copy(dst, src)
+	})
+}
+
+// BenchmarkProxyConnection proxies connections which can not be spliced.
+func BenchmarkProxyConnection(b *testing.B) {
+	hello := syntheticClientHello("example.com", nil)
+	data := append(hello, make([]byte, 256*1024)...)
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Failed to listen: %s", err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.CopyN(ioutil.Discard, conn, int64(len(data)))
+				conn.Close()
+			}()
+		}
+	}()
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.sniParser = OpaqueSNIParser{}
+	proxy.dialer = FixedDialer(backend.Addr().String())
+	proxy.Listen("tcp", "127.0.0.1:0")
+	defer proxy.listener.Close()
+	go proxy.Start()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil {
+			b.Fatalf("Failed to connect to proxy: %s", err)
+		}
+		conn.Write(data)
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClaimsPath is the location of the document on the onion service
+// which lists domains the onion service agrees to serve.
+// The document contains one domain per line; "*.example.com" covers
+// all subdomains of example.com. Lines starting with "#" are ignored.
+const ClaimsPath = "/.well-known/oniongateway-domains"
+
+// maxClaimsSize limits the size of the claims document.
+const maxClaimsSize = 64 * 1024
+
+// claimsErrorTTL is how long a failure to fetch claims is cached,
+// so one timeout over Tor does not block the host for the whole TTL.
+const claimsErrorTTL = 30 * time.Second
+
+type claimsEntry struct {
+	domains []string
+	err     error
+	expires time.Time
+}
+
+// ClaimVerifyingResolver is a decorator which accepts a mapping of host
+// to onion only if the onion service lists the host in its claims
+// document. The documents are fetched through the Tor dialer and cached.
+type ClaimVerifyingResolver struct {
+	resolver HostToOnionResolver
+	client   *http.Client
+	port     int
+	ttl      time.Duration
+	now      func() time.Time
+
+	mutex sync.Mutex
+	cache map[string]claimsEntry
+}
+
+func NewClaimVerifyingResolver(
+	resolver HostToOnionResolver,
+	dialer ProxyDialer,
+	port int,
+	ttl, timeout time.Duration,
+) *ClaimVerifyingResolver {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, addr string) (net.Conn, error) {
+				return dialer.Dial(addr)
+			},
+			DisableKeepAlives: true,
+		},
+		Timeout: timeout,
+	}
+	return &ClaimVerifyingResolver{
+		resolver: resolver,
+		client:   client,
+		port:     port,
+		ttl:      ttl,
+		now:      time.Now,
+		cache:    make(map[string]claimsEntry),
+	}
+}
+
+func parseClaims(body io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(io.LimitReader(body, maxClaimsSize))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domain := strings.ToLower(strings.TrimSuffix(line, "."))
+		domains = append(domains, domain)
+	}
+	return domains, scanner.Err()
+}
+
+func (r *ClaimVerifyingResolver) fetchClaims(onion string) ([]string, error) {
+	address := net.JoinHostPort(onion, strconv.Itoa(r.port))
+	response, err := r.client.Get("http://" + address + ClaimsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %d", response.StatusCode)
+	}
+	return parseClaims(response.Body)
+}
+
+// claims returns domains claimed by the onion service,
+// using cached result if it has not expired.
+func (r *ClaimVerifyingResolver) claims(onion string) ([]string, error) {
+	r.mutex.Lock()
+	entry, ok := r.cache[onion]
+	r.mutex.Unlock()
+	if ok && r.now().Before(entry.expires) {
+		return entry.domains, entry.err
+	}
+	domains, err := r.fetchClaims(onion)
+	if err != nil {
+		err = newResolveError(TemporaryFailure, "Unable to fetch claims of %s: %s", onion, err)
+	}
+	ttl := r.ttl
+	if err != nil && ttl > claimsErrorTTL {
+		ttl = claimsErrorTTL
+	}
+	r.mutex.Lock()
+	r.cache[onion] = claimsEntry{
+		domains: domains,
+		err:     err,
+		expires: r.now().Add(ttl),
+	}
+	r.mutex.Unlock()
+	return domains, err
+}
+
+func claimMatches(claim, hostname string) bool {
+	if strings.HasPrefix(claim, "*.") {
+		return strings.HasSuffix(hostname, claim[1:])
+	}
+	return claim == hostname
+}
+
+// verify checks if the onion service claims hostname.
+func (r *ClaimVerifyingResolver) verify(hostname, onion string) error {
+	domains, err := r.claims(onion)
+	if err != nil {
+		return err
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, claim := range domains {
+		if claimMatches(claim, hostname) {
+			return nil
+		}
+	}
+	return newResolveError(PolicyDenied, "%s does not claim %s", onion, hostname)
+}
+
+func (r *ClaimVerifyingResolver) ResolveToTargets(hostname string) ([]OnionTarget, error) {
+	targets, err := ResolveTargets(r.resolver, hostname)
+	if err != nil {
+		return nil, err
+	}
+	var verified []OnionTarget
+	for _, target := range targets {
+		err = r.verify(hostname, target.Onion)
+		if err == nil {
+			verified = append(verified, target)
+		}
+	}
+	if len(verified) == 0 {
+		return nil, newResolveError(
+			ResolveErrorKindOf(err),
+			"No onion confirmed %s: %s",
+			hostname,
+			err,
+		)
+	}
+	return verified, nil
+}
+
+func (r *ClaimVerifyingResolver) ResolveToOnion(hostname string) (string, error) {
+	targets, err := r.ResolveToTargets(hostname)
+	if err != nil {
+		return "", err
+	}
+	return targets[0].Onion, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type ClaimsServer struct {
+	server   *httptest.Server
+	requests int
+	fail     bool
+}
+
+func NewClaimsServer(claims string) *ClaimsServer {
+	s := &ClaimsServer{}
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s.requests++
+			if s.fail {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if r.URL.Path != ClaimsPath {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, claims)
+		},
+	))
+	return s
+}
+
+// FixedDialer connects to the same address whatever target is asked.
+type FixedDialer string
+
+func (d FixedDialer) Dial(targetServer string) (net.Conn, error) {
+	return net.Dial("tcp", string(d))
+}
+
+func makeClaimVerifyingResolver(claims string) (*ClaimVerifyingResolver, *ClaimsServer) {
+	server := NewClaimsServer(claims)
+	dialer := FixedDialer(server.server.Listener.Addr().String())
+	resolver := NewClaimVerifyingResolver(
+		MockOnionResolver("pastagdsp33j7aoq.onion"),
+		dialer,
+		80,
+		time.Hour,
+		time.Second,
+	)
+	return resolver, server
+}
+
+func TestClaimVerifyingResolver(t *testing.T) {
+	resolver, server := makeClaimVerifyingResolver(
+		"# domains of pasta\nPasta.cf.\n*.pasta.cf\n",
+	)
+	defer server.server.Close()
+	for _, host := range []string{"pasta.cf", "www.pasta.cf", "pasta.cf."} {
+		onion, err := resolver.ResolveToOnion(host)
+		if err != nil {
+			t.Fatalf("Failed to resolve %s: %s", host, err)
+		}
+		if onion != "pastagdsp33j7aoq.onion" {
+			t.Fatalf("Resolved %s to %s", host, onion)
+		}
+	}
+	for _, host := range []string{"example.com", "notpasta.cf"} {
+		if _, err := resolver.ResolveToOnion(host); err == nil {
+			t.Fatalf("Resolved unclaimed host %s", host)
+		}
+	}
+	if server.requests != 1 {
+		t.Fatalf("Claims were fetched %d times, expected once", server.requests)
+	}
+}
+
+func TestClaimVerifyingResolverTTL(t *testing.T) {
+	resolver, server := makeClaimVerifyingResolver("pasta.cf\n")
+	defer server.server.Close()
+	now := time.Unix(1500000000, 0)
+	resolver.now = func() time.Time { return now }
+	resolver.ResolveToOnion("pasta.cf")
+	now = now.Add(2 * time.Hour)
+	resolver.ResolveToOnion("pasta.cf")
+	if server.requests != 2 {
+		t.Fatalf("Claims were fetched %d times, expected twice", server.requests)
+	}
+}
+
+func TestClaimVerifyingResolverUnreachable(t *testing.T) {
+	resolver, server := makeClaimVerifyingResolver("pasta.cf\n")
+	server.server.Close()
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err == nil {
+		t.Fatalf("Resolved host of unreachable onion")
+	}
+}
+
+func TestClaimVerifyingResolverErrorTTL(t *testing.T) {
+	resolver, server := makeClaimVerifyingResolver("pasta.cf\n")
+	defer server.server.Close()
+	now := time.Unix(1500000000, 0)
+	resolver.now = func() time.Time { return now }
+	server.fail = true
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err == nil {
+		t.Fatalf("Resolved host of failing onion")
+	}
+	server.fail = false
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err == nil {
+		t.Fatalf("Failure was not cached")
+	}
+	now = now.Add(claimsErrorTTL)
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err != nil {
+		t.Fatalf("Failure was cached for too long: %s", err)
+	}
+	if server.requests != 2 {
+		t.Fatalf("Claims were fetched %d times, expected twice", server.requests)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// DefaultMaxClientHelloSize limits the size of ClientHello handshake
+// message (post-quantum key shares make it larger than a TLS record).
+const DefaultMaxClientHelloSize = 64 * 1024
+
+// maxRecordLength is the maximum length of plaintext TLS record, RFC 8446.
+const maxRecordLength = 16384
+
+const handshakeTypeClientHello byte = 1
+
+// TLS extension types.
+const (
+	extensionServerName        uint16 = 0
+	extensionALPN              uint16 = 16
+	extensionSupportedVersions uint16 = 43
+	extensionECH               uint16 = 0xfe0d
+)
+
+// ECHClientHelloType values, draft-ietf-tls-esni.
+const (
+	echClientHelloOuter uint8 = 0
+	echClientHelloInner uint8 = 1
+)
+
+// ClientHello is the part of TLS ClientHello the proxy is interested in.
+type ClientHello struct {
+	ServerName        string
+	ALPN              []string
+	SupportedVersions []uint16
+	CipherSuites      []uint16
+	Extensions        []uint16 // types of extensions, in order of appearance
+	LegacyVersion     uint16
+
+	// ECH is set if the ClientHello is the outer one of Encrypted
+	// ClientHello: ServerName is then public_name of ECH config
+	// (or the real name if the extension is GREASE).
+	ECH bool
+}
+
+// replayConn returns buffered bytes before reading from Conn.
+type replayConn struct {
+	net.Conn
+	buffered []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.buffered) == 0 {
+		return c.Conn.Read(b)
+	}
+	n := copy(b, c.buffered)
+	c.buffered = c.buffered[n:]
+	return n, nil
+}
+
+// ReadClientHello reads ClientHello from conn, possibly split into several
+// TLS records, and returns it with conn which replays the bytes read.
+func ReadClientHello(conn net.Conn, maxSize int) (*ClientHello, net.Conn, error) {
+	message, raw, err := readHandshakeMessage(conn, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	hello, err := ParseClientHello(message)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hello, &replayConn{Conn: conn, buffered: raw}, nil
+}
+
+// readHandshakeMessage reads TLS records until the first handshake message
+// is complete. It returns the message and all bytes read.
+func readHandshakeMessage(r io.Reader, maxSize int) ([]byte, []byte, error) {
+	var raw, message []byte
+	header := make([]byte, recordHeaderLength)
+	for {
+		if len(message) >= 4 {
+			length := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+			if message[0] != handshakeTypeClientHello {
+				return nil, nil, fmt.Errorf("Handshake message type %d is not ClientHello", message[0])
+			}
+			if 4+length > maxSize {
+				return nil, nil, fmt.Errorf("ClientHello of %d bytes exceeds limit of %d", 4+length, maxSize)
+			}
+			if len(message) >= 4+length {
+				if len(message) > 4+length {
+					return nil, nil, errors.New("Unexpected data after ClientHello")
+				}
+				return message, raw, nil
+			}
+		}
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, nil, err
+		}
+		if header[0] != recordTypeHandshake || header[1] != 3 {
+			return nil, nil, fmt.Errorf("Not a TLS handshake record: % x", header)
+		}
+		length := int(header[3])<<8 | int(header[4])
+		if length == 0 || length > maxRecordLength {
+			return nil, nil, fmt.Errorf("Bad TLS record length %d", length)
+		}
+		if len(message)+length > maxSize {
+			return nil, nil, fmt.Errorf("ClientHello exceeds limit of %d bytes", maxSize)
+		}
+		raw = append(raw, header...)
+		start := len(raw)
+		raw = append(raw, make([]byte, length)...)
+		if _, err := io.ReadFull(r, raw[start:]); err != nil {
+			return nil, nil, err
+		}
+		message = append(message, raw[start:]...)
+	}
+}
+
+// ParseClientHello parses ClientHello handshake message including
+// its 4 bytes header.
+func ParseClientHello(message []byte) (*ClientHello, error) {
+	hello := &ClientHello{}
+	input := cryptobyte.String(message)
+	var messageType uint8
+	var body cryptobyte.String
+	if !input.ReadUint8(&messageType) || messageType != handshakeTypeClientHello ||
+		!input.ReadUint24LengthPrefixed(&body) || !input.Empty() {
+		return nil, errors.New("Malformed ClientHello header")
+	}
+	var random, sessionID, cipherSuites, compressionMethods cryptobyte.String
+	if !body.ReadUint16(&hello.LegacyVersion) ||
+		!body.ReadBytes((*[]byte)(&random), 32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compressionMethods) {
+		return nil, errors.New("Malformed ClientHello")
+	}
+	if len(cipherSuites) == 0 || len(cipherSuites)%2 != 0 {
+		return nil, errors.New("Malformed cipher suites in ClientHello")
+	}
+	for !cipherSuites.Empty() {
+		var suite uint16
+		cipherSuites.ReadUint16(&suite)
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+	if body.Empty() {
+		// extensions are optional before TLS 1.3
+		return hello, nil
+	}
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) || !body.Empty() {
+		return nil, errors.New("Malformed extensions in ClientHello")
+	}
+	seen := make(map[uint16]bool)
+	for !extensions.Empty() {
+		var extension uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("Malformed extension in ClientHello")
+		}
+		if seen[extension] {
+			return nil, fmt.Errorf("Duplicate extension %d in ClientHello", extension)
+		}
+		seen[extension] = true
+		hello.Extensions = append(hello.Extensions, extension)
+		if err := hello.parseExtension(extension, data); err != nil {
+			return nil, err
+		}
+	}
+	return hello, nil
+}
+
+func (hello *ClientHello) parseExtension(extension uint16, data cryptobyte.String) error {
+	switch extension {
+	case extensionServerName:
+		var names cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&names) || names.Empty() || !data.Empty() {
+			return errors.New("Malformed server_name extension")
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return errors.New("Malformed server_name extension")
+			}
+			if nameType != 0 {
+				continue
+			}
+			if hello.ServerName != "" || len(name) == 0 {
+				return errors.New("Bad host_name in server_name extension")
+			}
+			hello.ServerName = string(name)
+		}
+	case extensionALPN:
+		var protocols cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&protocols) || protocols.Empty() || !data.Empty() {
+			return errors.New("Malformed ALPN extension")
+		}
+		for !protocols.Empty() {
+			var protocol cryptobyte.String
+			if !protocols.ReadUint8LengthPrefixed(&protocol) || len(protocol) == 0 {
+				return errors.New("Malformed ALPN extension")
+			}
+			hello.ALPN = append(hello.ALPN, string(protocol))
+		}
+	case extensionSupportedVersions:
+		var versions cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&versions) || versions.Empty() ||
+			len(versions)%2 != 0 || !data.Empty() {
+			return errors.New("Malformed supported_versions extension")
+		}
+		for !versions.Empty() {
+			var version uint16
+			versions.ReadUint16(&version)
+			hello.SupportedVersions = append(hello.SupportedVersions, version)
+		}
+	case extensionECH:
+		var helloType uint8
+		if !data.ReadUint8(&helloType) {
+			return errors.New("Malformed encrypted_client_hello extension")
+		}
+		switch helloType {
+		case echClientHelloOuter:
+			if data.Empty() {
+				return errors.New("Malformed encrypted_client_hello extension")
+			}
+			hello.ECH = true
+		case echClientHelloInner:
+			if !data.Empty() {
+				return errors.New("Malformed encrypted_client_hello extension")
+			}
+		default:
+			return fmt.Errorf("Unknown ECH ClientHello type %d", helloType)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// captureClientHello returns the first TLS record sent by crypto/tls client.
+func captureClientHello(t testing.TB, config *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+	header := make([]byte, recordHeaderLength)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("Failed to read record header: %s", err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("Failed to read record: %s", err)
+	}
+	return append(header, body...)
+}
+
+// splitRecords puts handshake message into records of at most size bytes.
+func splitRecords(message []byte, size int) []byte {
+	var records []byte
+	for len(message) > 0 {
+		n := size
+		if n > len(message) {
+			n = len(message)
+		}
+		records = append(records, recordTypeHandshake, 3, 1, byte(n>>8), byte(n))
+		records = append(records, message[:n]...)
+		message = message[n:]
+	}
+	return records
+}
+
+// readFromSegments feeds data to ReadClientHello in segments of given size.
+func readFromSegments(data []byte, segment, maxSize int) (*ClientHello, net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		defer client.Close()
+		for len(data) > 0 {
+			n := segment
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := client.Write(data[:n]); err != nil {
+				return
+			}
+			data = data[n:]
+		}
+	}()
+	hello, conn, err := ReadClientHello(server, maxSize)
+	if err != nil {
+		server.Close()
+		client.Close()
+	}
+	return hello, conn, err
+}
+
+var testClientHelloConfig = &tls.Config{
+	ServerName: "example.com",
+	NextProtos: []string{"h2", "http/1.1"},
+}
+
+func checkClientHello(t *testing.T, hello *ClientHello) {
+	if hello.ServerName != "example.com" {
+		t.Errorf("Got server name %q", hello.ServerName)
+	}
+	if !reflect.DeepEqual(hello.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("Got ALPN %v", hello.ALPN)
+	}
+	if len(hello.SupportedVersions) == 0 || hello.SupportedVersions[0] != tls.VersionTLS13 {
+		t.Errorf("Got supported versions %v", hello.SupportedVersions)
+	}
+	if len(hello.CipherSuites) == 0 {
+		t.Errorf("No cipher suites")
+	}
+	if hello.LegacyVersion != tls.VersionTLS12 {
+		t.Errorf("Got legacy version %x", hello.LegacyVersion)
+	}
+	for _, extension := range []uint16{extensionServerName, extensionALPN, extensionSupportedVersions} {
+		found := false
+		for _, e := range hello.Extensions {
+			found = found || e == extension
+		}
+		if !found {
+			t.Errorf("Extension %d is not in %v", extension, hello.Extensions)
+		}
+	}
+}
+
+func TestReadClientHello(t *testing.T) {
+	record := captureClientHello(t, testClientHelloConfig)
+	message := record[recordHeaderLength:]
+	for _, c := range []struct {
+		name             string
+		data             []byte
+		segment, maxSize int
+	}{
+		{"one record", record, len(record), DefaultMaxClientHelloSize},
+		{"byte by byte", record, 1, DefaultMaxClientHelloSize},
+		{"many records", splitRecords(message, 7), 3, DefaultMaxClientHelloSize},
+		{"exact limit", record, 100, len(message)},
+	} {
+		data := append(append([]byte{}, c.data...), "rest of stream"...)
+		hello, conn, err := readFromSegments(data, c.segment, c.maxSize)
+		if err != nil {
+			t.Errorf("%s: failed to read ClientHello: %s", c.name, err)
+			continue
+		}
+		checkClientHello(t, hello)
+		replayed, _ := ioutil.ReadAll(conn)
+		if !bytes.Equal(replayed, data) {
+			t.Errorf("%s: replayed %x, expected %x", c.name, replayed, data)
+		}
+	}
+}
+
+func TestReadClientHelloErrors(t *testing.T) {
+	record := captureClientHello(t, testClientHelloConfig)
+	message := record[recordHeaderLength:]
+	serverHello := append([]byte{2}, message[1:]...)
+	for name, c := range map[string]struct {
+		data    []byte
+		maxSize int
+	}{
+		"too large":       {record, len(message) - 1},
+		"too large split": {splitRecords(message, 100), 150},
+		"truncated":       {record[:len(record)-1], DefaultMaxClientHelloSize},
+		"not TLS":         {[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), DefaultMaxClientHelloSize},
+		"alert record":    {[]byte{21, 3, 1, 0, 2, 2, 40}, DefaultMaxClientHelloSize},
+		"empty record":    {[]byte{22, 3, 1, 0, 0}, DefaultMaxClientHelloSize},
+		"not ClientHello": {splitRecords(serverHello, 1000), DefaultMaxClientHelloSize},
+		"trailing data":   {splitRecords(append(append([]byte{}, message...), 0), 1000), DefaultMaxClientHelloSize},
+	} {
+		if _, _, err := readFromSegments(c.data, 10, c.maxSize); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestParseClientHelloWithoutExtensions(t *testing.T) {
+	body := []byte{3, 1}
+	body = append(body, make([]byte, 32)...)    // random
+	body = append(body, 0)                      // session id
+	body = append(body, 0, 4, 0, 0x2f, 0, 0x35) // cipher suites
+	body = append(body, 1, 0)                   // compression methods
+	message := append([]byte{1, 0, 0, byte(len(body))}, body...)
+	hello, err := ParseClientHello(message)
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	want := &ClientHello{LegacyVersion: 0x0301, CipherSuites: []uint16{0x2f, 0x35}}
+	if !reflect.DeepEqual(hello, want) {
+		t.Errorf("Got %#v, expected %#v", hello, want)
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	f.Add(captureClientHello(f, testClientHelloConfig)[recordHeaderLength:])
+	f.Add(captureClientHello(f, &tls.Config{ServerName: "example.org", MaxVersion: tls.VersionTLS12})[recordHeaderLength:])
+	f.Add(syntheticClientHello("public.example", outerECH)[recordHeaderLength:])
+	f.Fuzz(func(t *testing.T, message []byte) {
+		hello, err := ParseClientHello(message)
+		if err == nil && hello == nil {
+			t.Errorf("No ClientHello and no error")
+		}
+	})
+}
+
+func FuzzReadHandshakeMessage(f *testing.F) {
+	record := captureClientHello(f, testClientHelloConfig)
+	f.Add(record)
+	f.Add(splitRecords(record[recordHeaderLength:], 50))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message, raw, err := readHandshakeMessage(bytes.NewReader(data), 1024)
+		if err != nil {
+			return
+		}
+		if len(message) > 1024 || !bytes.HasPrefix(data, raw) {
+			t.Errorf("Got message of %d bytes and raw %x from %x", len(message), raw, data)
+		}
+	})
+}
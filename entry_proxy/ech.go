@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ParsePublicNames parses list "public_name=onion,public_name=onion".
+func ParsePublicNames(list string) (map[string]string, error) {
+	names := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected public_name=onion, got %q", pair)
+		}
+		name, err := NormalizeHostname(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		onion := strings.ToLower(parts[1])
+		if !onionRegexp.MatchString(onion) {
+			return nil, fmt.Errorf("Bad onion address %q", parts[1])
+		}
+		names[name] = onion
+	}
+	return names, nil
+}
+
+// ECHRouter handles connections using Encrypted ClientHello. The SNI
+// of them is public_name of ECH config, not the real site. Operators
+// publishing ECH configs pointing at a shared onion frontend map
+// public_name to that onion. The frontend decrypts the inner ClientHello.
+//
+// Browsers send GREASE ECH extension on most connections to sites
+// without ECH config, and it can not be told apart from real ECH. The SNI
+// is the real site then, so names not in the map are treated as plain SNI.
+type ECHRouter struct {
+	publicNames map[string]string // public_name -> onion
+
+	mutex    sync.Mutex
+	counts   map[string]int64 // public_name -> connections
+	plainSNI int64            // ECH or GREASE connections with other names
+}
+
+func NewECHRouter(publicNames map[string]string) *ECHRouter {
+	return &ECHRouter{
+		publicNames: publicNames,
+		counts:      make(map[string]int64),
+	}
+}
+
+// Counts returns number of connections routed by each public_name.
+func (r *ECHRouter) Counts() map[string]int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	counts := make(map[string]int64, len(r.counts))
+	for name, n := range r.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// PlainSNI returns number of connections with ECH extension whose
+// outer name is not a public_name, mostly GREASE.
+func (r *ECHRouter) PlainSNI() int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.plainSNI
+}
+
+// Route returns targets of the frontend onion if outerName is a known
+// public_name, or nil if outerName should be resolved as usual.
+func (r *ECHRouter) Route(outerName string) []OnionTarget {
+	onion, ok := r.publicNames[outerName]
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !ok {
+		r.plainSNI++
+		return nil
+	}
+	r.counts[outerName]++
+	return []OnionTarget{{Onion: onion}}
+}
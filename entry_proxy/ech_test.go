@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// syntheticClientHello builds TLS record with ClientHello having
+// server_name extension and, if ech is not nil, encrypted_client_hello
+// extension with ech as payload.
+func syntheticClientHello(serverName string, ech []byte) []byte {
+	var message cryptobyte.Builder
+	message.AddUint8(handshakeTypeClientHello)
+	message.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(tls.VersionTLS12)
+		b.AddBytes(make([]byte, 32)) // random
+		b.AddUint8(0)                // session id
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(tls.TLS_AES_128_GCM_SHA256)
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(0) // null compression
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(extensionServerName)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0) // host_name
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes([]byte(serverName))
+					})
+				})
+			})
+			if ech != nil {
+				b.AddUint16(extensionECH)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(ech)
+				})
+			}
+		})
+	})
+	return splitRecords(message.BytesOrPanic(), maxRecordLength)
+}
+
+// outerECH is ECHClientHello of outer type: cipher suite, config id,
+// encapsulated key and payload.
+var outerECH = []byte{
+	echClientHelloOuter,
+	0, 1, 0, 1, // HKDF-SHA256, AES-128-GCM
+	42,         // config id
+	0, 2, 1, 2, // enc
+	0, 3, 3, 4, 5, // payload
+}
+
+func TestParseClientHelloECH(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		ech  []byte
+		want bool
+		ok   bool
+	}{
+		{"no ECH", nil, false, true},
+		{"outer", outerECH, true, true},
+		{"inner", []byte{echClientHelloInner}, false, true},
+		{"empty", []byte{}, false, false},
+		{"empty outer", []byte{echClientHelloOuter}, false, false},
+		{"inner with data", []byte{echClientHelloInner, 1}, false, false},
+		{"unknown type", []byte{7, 1, 2}, false, false},
+	} {
+		record := syntheticClientHello("public.example", c.ech)
+		hello, err := ParseClientHello(record[recordHeaderLength:])
+		if !c.ok {
+			if err == nil {
+				t.Errorf("%s: expected error", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed to parse: %s", c.name, err)
+			continue
+		}
+		if hello.ServerName != "public.example" || hello.ECH != c.want {
+			t.Errorf("%s: got server name %q and ECH %v", c.name, hello.ServerName, hello.ECH)
+		}
+	}
+}
+
+func TestParsePublicNames(t *testing.T) {
+	names, err := ParsePublicNames("Public.Example=T3MNY6LHNYKU4WRD.onion,ech.pasta.cf.=pastagdsp33j7aoq.onion")
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	want := map[string]string{
+		"public.example": "t3mny6lhnyku4wrd.onion",
+		"ech.pasta.cf":   "pastagdsp33j7aoq.onion",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Got %v, expected %v", names, want)
+	}
+	for _, list := range []string{"", "public.example", "public.example=example.com", "bad_name!=t3mny6lhnyku4wrd.onion"} {
+		if _, err := ParsePublicNames(list); err == nil {
+			t.Errorf("Expected error for %q", list)
+		}
+	}
+}
+
+func TestProxyRoutesECH(t *testing.T) {
+	dialer := make(RecordingDialer, 1)
+	router := NewECHRouter(map[string]string{"public.example": "t3mny6lhnyku4wrd.onion"})
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.dialer = dialer
+	proxy.echRouter = router
+	proxy.Listen("tcp", "127.0.0.1:0")
+	defer proxy.listener.Close()
+	go proxy.Start()
+	for _, c := range []struct {
+		serverName string
+		ech        []byte
+		want       string
+	}{
+		{"public.example", outerECH, "t3mny6lhnyku4wrd.onion:443"},
+		// GREASE ECH: the SNI is the real site
+		{"example.com", outerECH, "pastagdsp33j7aoq.onion:443"},
+		// public name without ECH is an ordinary host
+		{"public.example", nil, "pastagdsp33j7aoq.onion:443"},
+	} {
+		conn, err := net.Dial("tcp", proxy.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %s", err)
+		}
+		conn.Write(syntheticClientHello(c.serverName, c.ech))
+		if got := <-dialer; got != c.want {
+			t.Errorf("%s (ECH %v): dialed %s, expected %s", c.serverName, c.ech != nil, got, c.want)
+		}
+		conn.Close()
+	}
+	want := map[string]int64{"public.example": 1}
+	if counts := router.Counts(); !reflect.DeepEqual(counts, want) {
+		t.Errorf("Got counts %v, expected %v", counts, want)
+	}
+	if n := router.PlainSNI(); n != 1 {
+		t.Errorf("Got %d ECH connections with plain SNI, expected 1", n)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// errorPageTimeout limits time spent on serving the error page.
+const errorPageTimeout = 10 * time.Second
+
+const defaultErrorPageTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{.Host}} is unavailable</title></head>
+<body>
+<h1>{{.Host}} is unavailable</h1>
+<p>The gateway was unable to connect to the onion service
+<code>{{.Onion}}</code> serving this site.</p>
+<p>Reason: {{.Reason}}</p>
+</body>
+</html>
+`
+
+// ErrorPageData is passed to the template of the error page.
+type ErrorPageData struct {
+	Host   string
+	Onion  string
+	Reason string // see errorPageReason
+}
+
+// errorPageReason describes failure to connect to the onion service
+// for anonymous visitors. Errors of the dialer name internal addresses
+// and details of Tor, so they are only logged.
+func errorPageReason(err error) string {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "The onion service did not respond in time."
+	}
+	return "The onion service is unreachable."
+}
+
+// ErrorPage terminates TLS locally to show the page explaining why
+// the site is unavailable. It is only used for hostnames covered by
+// the own certificates of the gateway.
+type ErrorPage struct {
+	certificates []tls.Certificate
+	leaves       []*x509.Certificate
+	template     *template.Template
+}
+
+// NewErrorPage loads certificate and key (PEM files) and the template of
+// the page. If templateFile is empty, the built-in template is used.
+func NewErrorPage(certFile, keyFile, templateFile string) (*ErrorPage, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse certificate: %s", err)
+	}
+	text := defaultErrorPageTemplate
+	if templateFile != "" {
+		data, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	tmpl, err := template.New("error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Bad error page template: %s", err)
+	}
+	return &ErrorPage{
+		certificates: []tls.Certificate{cert},
+		leaves:       []*x509.Certificate{leaf},
+		template:     tmpl,
+	}, nil
+}
+
+// Covers returns if the gateway has certificate for hostname.
+func (p *ErrorPage) Covers(hostname string) bool {
+	for _, leaf := range p.leaves {
+		if leaf.VerifyHostname(hostname) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve completes TLS handshake with the client (clientConn must replay
+// the ClientHello), reads one HTTP request and answers with the page.
+func (p *ErrorPage) Serve(clientConn net.Conn, data ErrorPageData) error {
+	var body bytes.Buffer
+	if err := p.template.Execute(&body, data); err != nil {
+		return err
+	}
+	clientConn.SetDeadline(time.Now().Add(errorPageTimeout))
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		Certificates: p.certificates,
+		NextProtos:   []string{"http/1.1"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	if _, err := http.ReadRequest(bufio.NewReader(tlsConn)); err != nil {
+		return err
+	}
+	response := fmt.Sprintf(
+		"HTTP/1.1 502 Bad Gateway\r\n"+
+			"Content-Type: text/html; charset=utf-8\r\n"+
+			"Content-Length: %d\r\n"+
+			"Cache-Control: no-store\r\n"+
+			"Connection: close\r\n\r\n",
+		body.Len(),
+	)
+	if _, err := tlsConn.Write(append([]byte(response), body.Bytes()...)); err != nil {
+		return err
+	}
+	return tlsConn.Close()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeErrorPage(t *testing.T) (*ErrorPage, *x509.CertPool) {
+	cert, leaf := makeCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"*.gateway.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	page := &ErrorPage{
+		certificates: []tls.Certificate{cert},
+		leaves:       []*x509.Certificate{leaf},
+		template:     template.Must(template.New("error").Parse(defaultErrorPageTemplate)),
+	}
+	return page, pool
+}
+
+func TestErrorPageCovers(t *testing.T) {
+	page, _ := makeErrorPage(t)
+	for hostname, want := range map[string]bool{
+		"pastagdsp33j7aoq.gateway.example": true,
+		"gateway.example":                  false,
+		"a.b.gateway.example":              false,
+		"example.com":                      false,
+	} {
+		if got := page.Covers(hostname); got != want {
+			t.Errorf("Covers(%q) = %v, expected %v", hostname, got, want)
+		}
+	}
+}
+
+func TestErrorPageServed(t *testing.T) {
+	const hostname = "pastagdsp33j7aoq.gateway.example"
+	page, pool := makeErrorPage(t)
+	proxy := startFailingProxy(MockOnionResolver("pastagdsp33j7aoq.onion"), hostname)
+	proxy.errorPage = page
+	defer proxy.listener.Close()
+	conn, err := tls.Dial("tcp", proxy.Addr().String(), &tls.Config{
+		ServerName: hostname,
+		RootCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %s", err)
+	}
+	defer conn.Close()
+	request, _ := http.NewRequest("GET", "https://"+hostname+"/", nil)
+	if err := request.Write(conn); err != nil {
+		t.Fatalf("Failed to send request: %s", err)
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), request)
+	if err != nil {
+		t.Fatalf("Failed to read response: %s", err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusBadGateway {
+		t.Errorf("Got status %d, expected 502", response.StatusCode)
+	}
+	for _, want := range []string{hostname, "pastagdsp33j7aoq.onion", "unreachable"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("Error page does not contain %q: %s", want, body)
+		}
+	}
+	if strings.Contains(string(body), "Tor is down") {
+		t.Errorf("Error page shows error of the dialer: %s", body)
+	}
+}
+
+func TestErrorPageReason(t *testing.T) {
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+	if reason := errorPageReason(timeout); !strings.Contains(reason, "in time") {
+		t.Errorf("Got reason %q for timeout", reason)
+	}
+	socksErr := errors.New("proxy: SOCKS5 proxy at 10.0.0.1:9050 failed to connect: host unreachable")
+	if reason := errorPageReason(socksErr); strings.Contains(reason, "10.0.0.1") {
+		t.Errorf("Got reason %q revealing the proxy", reason)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorPageNotUsedForOtherHosts(t *testing.T) {
+	page, _ := makeErrorPage(t)
+	proxy := startFailingProxy(MockOnionResolver("pastagdsp33j7aoq.onion"), "example.com")
+	proxy.errorPage = page
+	defer proxy.listener.Close()
+	_, err := tls.Dial("tcp", proxy.Addr().String(), &tls.Config{
+		ServerName: "example.com",
+	})
+	if err == nil || !strings.Contains(err.Error(), "internal error") {
+		t.Errorf("Expected internal error alert, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	maxHostnameLength = 253
+	maxLabelLength    = 63
+)
+
+// NormalizeHostname returns canonical form of hostname from SNI:
+// lowercase ASCII (IDN labels converted to punycode) without
+// trailing dot. Invalid names and IP addresses are rejected.
+func NormalizeHostname(hostname string) (string, error) {
+	name := strings.TrimSuffix(hostname, ".")
+	if name == "" {
+		return "", fmt.Errorf("Empty hostname")
+	}
+	if net.ParseIP(name) != nil {
+		return "", fmt.Errorf("Hostname %q is an IP address", hostname)
+	}
+	name, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("Bad hostname %q: %s", hostname, err)
+	}
+	if len(name) > maxHostnameLength {
+		return "", fmt.Errorf("Hostname %q is too long", hostname)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if err := checkLabel(label); err != nil {
+			return "", fmt.Errorf("Bad hostname %q: %s", hostname, err)
+		}
+	}
+	return name, nil
+}
+
+// checkLabel checks that label is a valid LDH label.
+func checkLabel(label string) error {
+	if label == "" {
+		return fmt.Errorf("empty label")
+	}
+	if len(label) > maxLabelLength {
+		return fmt.Errorf("label %q is too long", label)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("label %q starts or ends with hyphen", label)
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("bad character %q in label %q", c, label)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHostname(t *testing.T) {
+	for hostname, want := range map[string]string{
+		"example.com":           "example.com",
+		"Example.COM":           "example.com",
+		"example.com.":          "example.com",
+		"WWW.Pasta.CF.":         "www.pasta.cf",
+		"bücher.example":        "xn--bcher-kva.example",
+		"BÜCHER.example.":       "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"пример.рф":             "xn--e1afmkfd.xn--p1ai",
+		"a-b.example.com":       "a-b.example.com",
+	} {
+		got, err := NormalizeHostname(hostname)
+		if err != nil {
+			t.Errorf("Failed to normalize %q: %s", hostname, err)
+		} else if got != want {
+			t.Errorf("Normalized %q to %q, expected %q", hostname, got, want)
+		}
+	}
+}
+
+func TestNormalizeHostnameInvalid(t *testing.T) {
+	for _, hostname := range []string{
+		"",
+		".",
+		"example..com",
+		".example.com",
+		"example.com..",
+		"-example.com",
+		"example-.com",
+		"exa mple.com",
+		"exa_mple.com",
+		"example.com/",
+		"127.0.0.1",
+		"::1",
+		strings.Repeat("a", 64) + ".com",
+		strings.Repeat("abcdefghi.", 26) + "com",
+	} {
+		if got, err := NormalizeHostname(hostname); err == nil {
+			t.Errorf("Hostname %q was accepted as %q", hostname, got)
+		}
+	}
+}
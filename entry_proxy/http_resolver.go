@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// maxHTTPResolverResponse limits the size of the answer of the API.
+const maxHTTPResolverResponse = 64 * 1024
+
+// HTTPResolver resolves hosts by querying mapping service:
+// GET <endpoint>?host=<host> (added to the query of endpoint) answers with JSON
+// {"onion": "....onion", "port": 443, "ttl": 300}.
+// Status 404 means the host is not configured, 403 that it is denied.
+// Answers are cached for ttl seconds.
+type HTTPResolver struct {
+	endpoint *url.URL
+	token    string
+	client   *http.Client
+	now      func() time.Time
+
+	mutex sync.Mutex
+	cache map[string]httpResolverEntry
+}
+
+type httpResolverAnswer struct {
+	Onion string `json:"onion"`
+	Port  int    `json:"port"`
+	TTL   int    `json:"ttl"`
+}
+
+type httpResolverEntry struct {
+	target  OnionTarget
+	expires time.Time
+}
+
+// NewHTTPResolver creates HTTPResolver. If token is not empty, it is sent
+// as bearer token. tlsConfig (may be nil) is used for HTTPS endpoints.
+func NewHTTPResolver(
+	endpoint, token string,
+	timeout time.Duration,
+	tlsConfig *tls.Config,
+) (*HTTPResolver, error) {
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpointURL.Scheme != "http" && endpointURL.Scheme != "https" {
+		return nil, fmt.Errorf("Endpoint %q is not an HTTP URL", endpoint)
+	}
+	return &HTTPResolver{
+		endpoint: endpointURL,
+		token:    token,
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			Timeout:   timeout,
+		},
+		now:   time.Now,
+		cache: make(map[string]httpResolverEntry),
+	}, nil
+}
+
+// LoadClientTLSConfig makes TLS config with client certificate (for mTLS)
+// and CA used to verify the server. Empty file names are skipped.
+func LoadClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		caData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("No certificates in %s", caFile)
+		}
+	}
+	return config, nil
+}
+
+func (r *HTTPResolver) query(hostname string) (httpResolverAnswer, error) {
+	var answer httpResolverAnswer
+	requestURL := *r.endpoint
+	query := requestURL.Query()
+	query.Set("host", hostname)
+	requestURL.RawQuery = query.Encode()
+	request, err := http.NewRequest("GET", requestURL.String(), nil)
+	if err != nil {
+		return answer, newResolveError(TemporaryFailure, "Bad request: %s", err)
+	}
+	if r.token != "" {
+		request.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	response, err := r.client.Do(request)
+	if err != nil {
+		return answer, newResolveError(TemporaryFailure, "Mapping service failed: %s", err)
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return answer, newResolveError(NotFound, "Mapping service does not know %s", hostname)
+	case http.StatusForbidden:
+		return answer, newResolveError(PolicyDenied, "Mapping service denied %s", hostname)
+	default:
+		return answer, newResolveError(
+			TemporaryFailure,
+			"Mapping service returned status %d for %s",
+			response.StatusCode,
+			hostname,
+		)
+	}
+	body := io.LimitReader(response.Body, maxHTTPResolverResponse)
+	if err := json.NewDecoder(body).Decode(&answer); err != nil {
+		return answer, newResolveError(InvalidRecord, "Bad answer for %s: %s", hostname, err)
+	}
+	if !onionRegexp.MatchString(answer.Onion) || answer.Port < 0 || answer.Port > 65535 {
+		return answer, newResolveError(InvalidRecord, "Bad answer for %s: %v", hostname, answer)
+	}
+	return answer, nil
+}
+
+func (r *HTTPResolver) ResolveToTargets(hostname string) ([]OnionTarget, error) {
+	r.mutex.Lock()
+	entry, ok := r.cache[hostname]
+	r.mutex.Unlock()
+	if ok && r.now().Before(entry.expires) {
+		return []OnionTarget{entry.target}, nil
+	}
+	answer, err := r.query(hostname)
+	if err != nil {
+		return nil, err
+	}
+	target := OnionTarget{Onion: answer.Onion, Port: answer.Port}
+	if answer.TTL > 0 {
+		r.mutex.Lock()
+		r.cache[hostname] = httpResolverEntry{
+			target:  target,
+			expires: r.now().Add(time.Duration(answer.TTL) * time.Second),
+		}
+		r.mutex.Unlock()
+	}
+	return []OnionTarget{target}, nil
+}
+
+func (r *HTTPResolver) ResolveToOnion(hostname string) (string, error) {
+	targets, err := r.ResolveToTargets(hostname)
+	if err != nil {
+		return "", err
+	}
+	return targets[0].Onion, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func mappingHandler(requests *int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Query().Get("host") {
+		case "pasta.cf":
+			fmt.Fprint(w, `{"onion": "pastagdsp33j7aoq.onion", "port": 8443, "ttl": 60}`)
+		case "denied.com":
+			w.WriteHeader(http.StatusForbidden)
+		case "broken.com":
+			fmt.Fprint(w, `{"onion": "broken"}`)
+		case "error.com":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func makeHTTPResolver(t *testing.T, endpoint string, tlsConfig *tls.Config) *HTTPResolver {
+	resolver, err := NewHTTPResolver(endpoint, "secret", time.Second, tlsConfig)
+	if err != nil {
+		t.Fatalf("Failed to create resolver: %s", err)
+	}
+	return resolver
+}
+
+func TestHTTPResolver(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(mappingHandler(&requests))
+	defer server.Close()
+	resolver := makeHTTPResolver(t, server.URL+"/resolve", nil)
+	now := time.Unix(1500000000, 0)
+	resolver.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		targets, err := resolver.ResolveToTargets("pasta.cf")
+		if err != nil {
+			t.Fatalf("Failed to resolve: %s", err)
+		}
+		want := OnionTarget{Onion: "pastagdsp33j7aoq.onion", Port: 8443}
+		if len(targets) != 1 || targets[0] != want {
+			t.Fatalf("Got %v, expected %v", targets, want)
+		}
+	}
+	if requests != 1 {
+		t.Fatalf("Expected answer to be cached, got %d requests", requests)
+	}
+	now = now.Add(time.Minute)
+	resolver.ResolveToOnion("pasta.cf")
+	if requests != 2 {
+		t.Fatalf("Expected cache to expire, got %d requests", requests)
+	}
+	for host, want := range map[string]ResolveErrorKind{
+		"unknown.com": NotFound,
+		"denied.com":  PolicyDenied,
+		"broken.com":  InvalidRecord,
+		"error.com":   TemporaryFailure,
+	} {
+		_, err := resolver.ResolveToOnion(host)
+		checkErrorKind(t, host, err, want)
+	}
+	resolver.token = "wrong"
+	_, err := resolver.ResolveToOnion("example.com")
+	checkErrorKind(t, "bad token", err, TemporaryFailure)
+}
+
+func TestHTTPResolverUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	resolver := makeHTTPResolver(t, server.URL, nil)
+	_, err := resolver.ResolveToOnion("pasta.cf")
+	checkErrorKind(t, "unreachable", err, TemporaryFailure)
+}
+
+func makeCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+func TestHTTPResolverMutualTLS(t *testing.T) {
+	notAfter := time.Now().Add(time.Hour)
+	caCert, ca := makeCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	caKey := caCert.PrivateKey.(*ecdsa.PrivateKey)
+	clientCert, _ := makeCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gateway"},
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	requests := 0
+	server := httptest.NewUnstartedServer(mappingHandler(&requests))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	server.StartTLS()
+	defer server.Close()
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(server.Certificate())
+
+	resolver := makeHTTPResolver(t, server.URL, &tls.Config{
+		RootCAs:      serverCAs,
+		Certificates: []tls.Certificate{clientCert},
+	})
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err != nil {
+		t.Fatalf("Failed to resolve with client certificate: %s", err)
+	}
+	resolver = makeHTTPResolver(t, server.URL, &tls.Config{
+		RootCAs: serverCAs,
+	})
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err == nil {
+		t.Fatalf("Resolved without client certificate")
+	}
+}
+
+func TestHTTPResolverEndpointQuery(t *testing.T) {
+	var requests int
+	handler := mappingHandler(&requests)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("version") != "2" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	resolver := makeHTTPResolver(t, server.URL+"/resolve?version=2", nil)
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+}
+
+func TestHTTPResolverBadEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"%zz", "ftp://example.com/", "example.com/resolve"} {
+		if _, err := NewHTTPResolver(endpoint, "", time.Second, nil); err == nil {
+			t.Errorf("Endpoint %q was accepted", endpoint)
+		}
+	}
+}
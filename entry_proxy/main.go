@@ -12,11 +12,14 @@ See also:
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	"golang.org/x/crypto/ed25519"
 )
 
 func main() {
@@ -49,20 +52,232 @@ func main() {
 		hostToOnionTable = flag.String(
 			"host-to-onion",
 			"",
-			"Yaml file with host->onion map, disables DNS based resolver",
+			"Yaml, JSON or CSV file (or directory of such files) with host->onion map, disables DNS based resolver",
 		)
 		parentHost = flag.String(
 			"parent-host",
 			"",
-			"Read onion address in subdomain of specified domain, disables DNS based resolver",
+			"Read onion address in subdomain of specified domains (comma separated), disables DNS based resolver",
+		)
+		parentHostAnyDepth = flag.Bool(
+			"parent-host-any-depth",
+			false,
+			"Accept onion address anywhere in subdomain, not only directly under parent domain",
+		)
+		resolverCommand = flag.String(
+			"resolver-command",
+			"",
+			"Helper executable (with arguments) resolving hosts to onions, disables DNS based resolver",
+		)
+		resolverTimeout = flag.Duration(
+			"resolver-timeout",
+			5*time.Second,
+			"Timeout of requests to -resolver-command and -resolver-url",
+		)
+		resolverURL = flag.String(
+			"resolver-url",
+			"",
+			"URL of mapping service queried as <url>?host=<host>, disables DNS based resolver",
+		)
+		resolverToken = flag.String(
+			"resolver-token",
+			"",
+			"Bearer token for -resolver-url",
+		)
+		resolverCert = flag.String(
+			"resolver-cert",
+			"",
+			"Client certificate (PEM) for -resolver-url",
+		)
+		resolverKey = flag.String(
+			"resolver-key",
+			"",
+			"Key of client certificate (PEM) for -resolver-url",
+		)
+		resolverCA = flag.String(
+			"resolver-ca",
+			"",
+			"CA certificates (PEM) to verify -resolver-url (default: system CAs)",
+		)
+		requireSignature = flag.Bool(
+			"require-signature",
+			false,
+			"Only use TXT records signed by the onion service (see sign_onion_binding)",
+		)
+		gatewayID = flag.String(
+			"gateway-id",
+			"",
+			"Identifier of this gateway; if set, only TXT records listing it in gateways= are used",
+		)
+		verifyClaims = flag.Bool(
+			"verify-claims",
+			false,
+			"Only proxy to onions listing the host in "+ClaimsPath,
+		)
+		claimsPort = flag.Int(
+			"claims-port",
+			80,
+			"Port on onion site serving "+ClaimsPath,
+		)
+		claimsTTL = flag.Duration(
+			"claims-ttl",
+			time.Hour,
+			"How long to cache claims of onion sites",
+		)
+		policyFiles = flag.String(
+			"policy",
+			"",
+			"Files with allow/block rules for hosts and onions (comma separated), reloaded on SIGHUP",
+		)
+		blocklistFeeds = flag.String(
+			"blocklist-feeds",
+			"",
+			"URLs of signed blocklists (comma separated)",
+		)
+		blocklistKeys = flag.String(
+			"blocklist-keys",
+			"",
+			"Base64 ed25519 keys of blocklist publishers (comma separated)",
+		)
+		blocklistState = flag.String(
+			"blocklist-state",
+			"",
+			"Yaml file keeping versions of blocklists accepted so far, so older lists are rejected after restart",
+		)
+		blocklistInterval = flag.Duration(
+			"blocklist-interval",
+			time.Hour,
+			"How often to fetch blocklists",
+		)
+		socketOptions = flag.String(
+			"socket-options",
+			"",
+			"Yaml file with TCP options of client (client:) and Tor (tor:) connections",
+		)
+		handshakeTimeout = flag.Duration(
+			"handshake-timeout",
+			DefaultHandshakeTimeout,
+			"Time clients have to send ClientHello (0 for no limit)",
+		)
+		statsInterval = flag.Duration(
+			"stats-interval",
+			10*time.Minute,
+			"How often to log connection counters (0 to disable)",
+		)
+		workers = flag.Int(
+			"workers",
+			0,
+			"Number of connections processed at once (0 for no limit)",
+		)
+		queueDepth = flag.Int(
+			"queue-depth",
+			100,
+			"Number of connections waiting for -workers, others are dropped",
+		)
+		bufferSize = flag.Int(
+			"buffer-size",
+			DefaultBufferSize,
+			"Size of buffers copying streams which can not be spliced",
+		)
+		bufferBudget = flag.Int64(
+			"buffer-budget",
+			0,
+			"Soft limit of total size of copy buffers in bytes, streams use only small buffers over it (0 for no limit)",
+		)
+		noSNI = flag.String(
+			"no-sni",
+			"reject",
+			"What to do with clients sending no SNI: reject, default (use -no-sni-onion) or local-address (use -no-sni-hosts)",
+		)
+		noSNIOnion = flag.String(
+			"no-sni-onion",
+			"",
+			"Onion for clients sending no SNI in -no-sni=default mode",
+		)
+		noSNIHosts = flag.String(
+			"no-sni-hosts",
+			"",
+			"Hosts of local IP addresses (ip=host, comma separated) for -no-sni=local-address mode",
+		)
+		echPublicNames = flag.String(
+			"ech-public-names",
+			"",
+			"ECH public names served by shared onion frontends (public_name=onion, comma separated)",
+		)
+		alpnRoutes = flag.String(
+			"alpn-routes",
+			"",
+			"File with routes \"<host|*> <alpn protocol> <port|onion|onion:port>\"",
+		)
+		errorPageCert = flag.String(
+			"error-page-cert",
+			"",
+			"Certificate (PEM) of the gateway; for hosts it covers, error page is shown if onion is unreachable",
+		)
+		errorPageKey = flag.String(
+			"error-page-key",
+			"",
+			"Key of -error-page-cert (PEM)",
+		)
+		errorPageTemplate = flag.String(
+			"error-page-template",
+			"",
+			"HTML template of error page with fields .Host, .Onion and .Reason (default: built-in)",
+		)
+		tofuFile = flag.String(
+			"tofu-file",
+			"",
+			"Yaml file to pin onions first seen for each host ('' to disable)",
+		)
+		tofuPolicy = flag.String(
+			"tofu-policy",
+			"warn",
+			"What to do when onion of pinned host changes: warn (log and pin the new onion) or block (until -tofu-approve)",
+		)
+		tofuApprove = flag.String(
+			"tofu-approve",
+			"",
+			"Approve blocked change of onion of specified host and exit (a running proxy picks it up)",
 		)
 	)
 
 	flag.Parse()
 
+	var tofu *TOFUResolver
+	if *tofuFile != "" {
+		policy, err := ParseTOFUPolicy(*tofuPolicy)
+		if err != nil {
+			log.Fatalf("Bad -tofu-policy: %s", err)
+		}
+		tofu, err = NewTOFUResolver(nil, *tofuFile, policy)
+		if err != nil {
+			log.Fatalf("Error loading %s: %s", *tofuFile, err)
+		}
+	}
+	if *tofuApprove != "" {
+		if tofu == nil {
+			log.Fatalf("-tofu-approve requires -tofu-file")
+		}
+		if err := tofu.Approve(*tofuApprove); err != nil {
+			log.Fatalf("Unable to approve change: %s", err)
+		}
+		log.Printf("Approved change of onion of %s", *tofuApprove)
+		return
+	}
+
+	socketConfig := &SocketConfig{}
+	if *socketOptions != "" {
+		var err error
+		socketConfig, err = LoadSocketConfig(*socketOptions)
+		if err != nil {
+			log.Fatalf("Error loading %s: %s", *socketOptions, err)
+		}
+	}
+
 	// Check if Tor2Web mode is enabled.
 	// Tor does not provide access to clearnet sites in Tor2Web mode.
 	dialer := NewSocksDialer(*proxyNet, *proxyAddr)
+	dialer.forward = NewOptionsDialer(socketConfig.Tor)
 	site4test := "check.torproject.org:443"
 	if _, err := dialer.Dial(site4test); err == nil {
 		log.Printf(
@@ -83,26 +298,172 @@ func main() {
 	var resolver HostToOnionResolver
 	if *hostToOnionTable != "" {
 		log.Printf("Using host2onion map from file %s", *hostToOnionTable)
-		configData, err := ioutil.ReadFile(*hostToOnionTable)
+		staticResolver, err := LoadStaticResolverPath(*hostToOnionTable)
 		if err != nil {
-			log.Fatalf("Error reading %s: %s", *hostToOnionTable, err)
+			log.Fatalf("Error loading %s: %s", *hostToOnionTable, err)
 		}
-		var staticResolver StaticResolver
-		err = yaml.Unmarshal(configData, &staticResolver)
+		resolver = staticResolver
+	} else if *parentHost != "" {
+		log.Printf("Using domains %s as parent hosts", *parentHost)
+		subdomainResolver := NewSubdomainResolver(strings.Split(*parentHost, ",")...)
+		subdomainResolver.anyDepth = *parentHostAnyDepth
+		resolver = subdomainResolver
+	} else if *resolverCommand != "" {
+		log.Printf("Using resolver helper %s", *resolverCommand)
+		command := strings.Fields(*resolverCommand)
+		resolver = NewProcessResolver(*resolverTimeout, command[0], command[1:]...)
+	} else if *resolverURL != "" {
+		log.Printf("Using mapping service %s", *resolverURL)
+		tlsConfig, err := LoadClientTLSConfig(*resolverCert, *resolverKey, *resolverCA)
 		if err != nil {
-			log.Fatalf("Error parsing %s: %s", *hostToOnionTable, err)
+			log.Fatalf("Error loading TLS config of -resolver-url: %s", err)
+		}
+		resolver, err = NewHTTPResolver(*resolverURL, *resolverToken, *resolverTimeout, tlsConfig)
+		if err != nil {
+			log.Fatalf("Bad -resolver-url: %s", err)
 		}
-		resolver = &staticResolver
-	} else if *parentHost != "" {
-		log.Printf("Using domain %s as parent host", *parentHost)
-		resolver = NewSubdomainResolver(*parentHost)
 	} else {
-		resolver = NewDnsHostToOnionResolver()
+		dnsResolver := NewDnsHostToOnionResolver()
+		dnsResolver.requireSignature = *requireSignature
+		dnsResolver.gatewayID = *gatewayID
+		resolver = dnsResolver
+	}
+	var proxyPolicy *Policy
+	if *policyFiles != "" || *blocklistFeeds != "" {
+		var files []string
+		if *policyFiles != "" {
+			files = strings.Split(*policyFiles, ",")
+		}
+		policy, err := NewPolicy(files...)
+		if err != nil {
+			log.Fatalf("Error loading policy: %s", err)
+		}
+		reloadOnSignal(policy)
+		if *blocklistFeeds != "" {
+			var keys []ed25519.PublicKey
+			for _, encoded := range strings.Split(*blocklistKeys, ",") {
+				key, err := ParsePublisherKey(encoded)
+				if err != nil {
+					log.Fatalf("Bad -blocklist-keys: %s", err)
+				}
+				keys = append(keys, key)
+			}
+			var state *BlocklistState
+			if *blocklistState != "" {
+				state, err = LoadBlocklistState(*blocklistState)
+				if err != nil {
+					log.Fatalf("Error loading %s: %s", *blocklistState, err)
+				}
+			}
+			for _, url := range strings.Split(*blocklistFeeds, ",") {
+				feed := NewBlocklistFeed(url, keys, policy, state, time.Minute)
+				go feed.Run(*blocklistInterval)
+			}
+		}
+		// blocked onions must not be contacted for claims or pinned
+		resolver = NewPolicyResolver(resolver, policy)
+		proxyPolicy = policy
+	}
+	if *verifyClaims {
+		resolver = NewClaimVerifyingResolver(
+			resolver,
+			dialer,
+			*claimsPort,
+			*claimsTTL,
+			time.Minute,
+		)
+	}
+	if tofu != nil {
+		tofu.resolver = resolver
+		resolver = tofu
 	}
 
 	proxy := NewTLSProxy(*onionPort, *proxyNet, *proxyAddr, resolver)
+	proxy.policy = proxyPolicy
+	proxy.dialer = dialer
+	proxy.clientOptions = socketConfig.Client
+	proxy.handshakeTimeout = *handshakeTimeout
+	proxy.workers = *workers
+	proxy.queueDepth = *queueDepth
+	if *bufferSize < smallBufferSize {
+		log.Fatalf("-buffer-size must be at least %d", smallBufferSize)
+	}
+	proxy.buffers = NewBufferPool(*bufferSize, *bufferBudget)
+	noSNIMode, err := ParseNoSNIMode(*noSNI)
+	if err != nil {
+		log.Fatalf("Bad -no-sni: %s", err)
+	}
+	var localHosts map[string]string
+	switch noSNIMode {
+	case NoSNIDefaultOnion:
+		if !onionRegexp.MatchString(*noSNIOnion) {
+			log.Fatalf("-no-sni=default requires valid -no-sni-onion")
+		}
+	case NoSNILocalAddress:
+		localHosts, err = ParseLocalHosts(*noSNIHosts)
+		if err != nil {
+			log.Fatalf("Bad -no-sni-hosts: %s", err)
+		}
+	}
+	proxy.noSNIRouter = NewNoSNIRouter(noSNIMode, *noSNIOnion, localHosts)
+	publicNames := make(map[string]string)
+	if *echPublicNames != "" {
+		publicNames, err = ParsePublicNames(*echPublicNames)
+		if err != nil {
+			log.Fatalf("Bad -ech-public-names: %s", err)
+		}
+	}
+	proxy.echRouter = NewECHRouter(publicNames)
+	if *alpnRoutes != "" {
+		router, err := LoadALPNRoutes(*alpnRoutes)
+		if err != nil {
+			log.Fatalf("Error loading ALPN routes: %s", err)
+		}
+		proxy.alpnRouter = router
+	}
+	if *errorPageCert != "" {
+		errorPage, err := NewErrorPage(*errorPageCert, *errorPageKey, *errorPageTemplate)
+		if err != nil {
+			log.Fatalf("Error loading error page: %s", err)
+		}
+		proxy.errorPage = errorPage
+	}
 	proxy.Listen("tcp", *entryProxy)
+	if *statsInterval > 0 {
+		go logStats(proxy, *statsInterval)
+	}
 
 	log.Printf("starting entry proxy")
 	proxy.Start()
 }
+
+// reloadOnSignal reloads policy when SIGHUP is received.
+func reloadOnSignal(policy *Policy) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := policy.Reload(); err != nil {
+				log.Printf("Unable to reload policy: %s", err)
+			} else {
+				log.Printf("Policy reloaded")
+			}
+		}
+	}()
+}
+
+// logStats logs counters of the proxy every interval.
+func logStats(proxy *TLSProxy, interval time.Duration) {
+	for range time.Tick(interval) {
+		if proxy.noSNIRouter != nil {
+			log.Printf("Stats: connections without SNI %v", proxy.noSNIRouter.Counts())
+		}
+		if proxy.workers > 0 {
+			log.Printf("Stats: connections dropped by full queue %d", proxy.Shed())
+		}
+		if proxy.echRouter != nil {
+			log.Printf("Stats: ECH connections by public name %v", proxy.echRouter.Counts())
+			log.Printf("Stats: ECH connections with plain SNI %d", proxy.echRouter.PlainSNI())
+		}
+	}
+}
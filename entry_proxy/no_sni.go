@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// NoSNIMode is what to do with clients which send no SNI.
+type NoSNIMode int
+
+const (
+	// NoSNIReject closes the connection with TLS alert.
+	NoSNIReject NoSNIMode = iota
+	// NoSNIDefaultOnion proxies the connection to the default onion.
+	NoSNIDefaultOnion
+	// NoSNILocalAddress uses hostname assigned to the local address
+	// the client connected to (one IP per site).
+	NoSNILocalAddress
+)
+
+func ParseNoSNIMode(name string) (NoSNIMode, error) {
+	switch name {
+	case "reject":
+		return NoSNIReject, nil
+	case "default":
+		return NoSNIDefaultOnion, nil
+	case "local-address":
+		return NoSNILocalAddress, nil
+	}
+	return NoSNIReject, fmt.Errorf("Unknown mode %q, expected reject, default or local-address", name)
+}
+
+// ParseLocalHosts parses list "ip=hostname,ip=hostname".
+func ParseLocalHosts(list string) (map[string]string, error) {
+	hosts := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected ip=hostname, got %q", pair)
+		}
+		ip := net.ParseIP(parts[0])
+		if ip == nil {
+			return nil, fmt.Errorf("Bad IP address %q", parts[0])
+		}
+		hostname, err := NormalizeHostname(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		hosts[ip.String()] = hostname
+	}
+	return hosts, nil
+}
+
+// NoSNIRouter decides where connections without SNI go
+// and counts them by the outcome.
+type NoSNIRouter struct {
+	mode         NoSNIMode
+	defaultOnion string
+	localHosts   map[string]string // IP address -> hostname
+
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+func NewNoSNIRouter(mode NoSNIMode, defaultOnion string, localHosts map[string]string) *NoSNIRouter {
+	return &NoSNIRouter{
+		mode:         mode,
+		defaultOnion: defaultOnion,
+		localHosts:   localHosts,
+		counts:       make(map[string]int64),
+	}
+}
+
+func (r *NoSNIRouter) count(outcome string) int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.counts[outcome]++
+	return r.counts[outcome]
+}
+
+// Counts returns number of connections without SNI by outcome:
+// "rejected", "default onion", "local address" or "unknown local address".
+func (r *NoSNIRouter) Counts() map[string]int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	counts := make(map[string]int64, len(r.counts))
+	for outcome, n := range r.counts {
+		counts[outcome] = n
+	}
+	return counts
+}
+
+// Route returns hostname for connection without SNI. Targets are
+// returned too if the hostname must not be resolved.
+func (r *NoSNIRouter) Route(conn net.Conn) (string, []OnionTarget, error) {
+	remote := conn.RemoteAddr()
+	switch r.mode {
+	case NoSNIDefaultOnion:
+		n := r.count("default onion")
+		log.Printf("No SNI from %s: using default onion %s (%d times)", remote, r.defaultOnion, n)
+		return r.defaultOnion, []OnionTarget{{Onion: r.defaultOnion}}, nil
+	case NoSNILocalAddress:
+		ip := ""
+		if host, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+			if parsed := net.ParseIP(host); parsed != nil {
+				ip = parsed.String()
+			}
+		}
+		hostname, ok := r.localHosts[ip]
+		if !ok {
+			n := r.count("unknown local address")
+			log.Printf("No SNI from %s: no host for local address %s (%d times)", remote, conn.LocalAddr(), n)
+			return "", nil, fmt.Errorf("No host for local address %s", conn.LocalAddr())
+		}
+		n := r.count("local address")
+		log.Printf("No SNI from %s: using %s of local address %s (%d times)", remote, hostname, ip, n)
+		return hostname, nil, nil
+	}
+	n := r.count("rejected")
+	log.Printf("No SNI from %s: rejected (%d times)", remote, n)
+	return "", nil, fmt.Errorf("Client %s sent no SNI", remote)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLocalHosts(t *testing.T) {
+	hosts, err := ParseLocalHosts("192.0.2.1=Pasta.cf,2001:db8:0::1=example.com.")
+	if err != nil {
+		t.Fatalf("Failed to parse: %s", err)
+	}
+	want := map[string]string{"192.0.2.1": "pasta.cf", "2001:db8::1": "example.com"}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Got %v, expected %v", hosts, want)
+	}
+	for _, list := range []string{"", "192.0.2.1", "pasta.cf=192.0.2.1", "192.0.2.1=bad_host!"} {
+		if _, err := ParseLocalHosts(list); err == nil {
+			t.Errorf("Expected error for %q", list)
+		}
+	}
+}
+
+func TestParseNoSNIMode(t *testing.T) {
+	for name, want := range map[string]NoSNIMode{
+		"reject":        NoSNIReject,
+		"default":       NoSNIDefaultOnion,
+		"local-address": NoSNILocalAddress,
+	} {
+		if mode, err := ParseNoSNIMode(name); err != nil || mode != want {
+			t.Errorf("ParseNoSNIMode(%q) = %v, %v", name, mode, err)
+		}
+	}
+	if _, err := ParseNoSNIMode("drop"); err == nil {
+		t.Errorf("Expected error for unknown mode")
+	}
+}
+
+// dialWithoutSNI connects to proxy and returns target dialed by it
+// or the error of TLS handshake.
+func dialWithoutSNI(t *testing.T, router *NoSNIRouter) (string, error) {
+	dialer := make(RecordingDialer, 1)
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.dialer = dialer
+	proxy.noSNIRouter = router
+	proxy.Listen("tcp", "127.0.0.1:0")
+	defer proxy.listener.Close()
+	go proxy.Start()
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %s", err)
+	}
+	defer conn.Close()
+	err = tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	select {
+	case target := <-dialer:
+		return target, err
+	default:
+		return "", err
+	}
+}
+
+func TestNoSNIRouting(t *testing.T) {
+	defaultRouter := NewNoSNIRouter(NoSNIDefaultOnion, "t3mny6lhnyku4wrd.onion", nil)
+	target, _ := dialWithoutSNI(t, defaultRouter)
+	if target != "t3mny6lhnyku4wrd.onion:443" {
+		t.Errorf("Default onion mode dialed %q", target)
+	}
+
+	localRouter := NewNoSNIRouter(NoSNILocalAddress, "", map[string]string{"127.0.0.1": "example.com"})
+	target, _ = dialWithoutSNI(t, localRouter)
+	if target != "pastagdsp33j7aoq.onion:443" {
+		t.Errorf("Local address mode dialed %q", target)
+	}
+	localRouter.localHosts = map[string]string{"192.0.2.1": "example.com"}
+	target, err := dialWithoutSNI(t, localRouter)
+	if target != "" || err == nil || !strings.Contains(err.Error(), "unrecognized name") {
+		t.Errorf("Unknown local address: dialed %q, error %v", target, err)
+	}
+
+	rejectRouter := NewNoSNIRouter(NoSNIReject, "", nil)
+	for i := 0; i < 2; i++ {
+		target, err = dialWithoutSNI(t, rejectRouter)
+		if target != "" || err == nil || !strings.Contains(err.Error(), "unrecognized name") {
+			t.Errorf("Reject mode: dialed %q, error %v", target, err)
+		}
+	}
+
+	for router, want := range map[*NoSNIRouter]map[string]int64{
+		defaultRouter: {"default onion": 1},
+		localRouter:   {"local address": 1, "unknown local address": 1},
+		rejectRouter:  {"rejected": 2},
+	} {
+		if counts := router.Counts(); !reflect.DeepEqual(counts, want) {
+			t.Errorf("Got counts %v, expected %v", counts, want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PolicyRule allows or blocks hosts or onions matching Pattern.
+// Host patterns are hostnames or "*.example.com" for all subdomains.
+type PolicyRule struct {
+	Action  string // "allow" or "block"
+	Kind    string // "host" or "onion"
+	Pattern string
+	Source  string // where the rule comes from, for logging
+}
+
+func (r PolicyRule) String() string {
+	return fmt.Sprintf("%s %s %s (%s)", r.Action, r.Kind, r.Pattern, r.Source)
+}
+
+func (r PolicyRule) matches(kind, name string) bool {
+	if r.Kind != kind {
+		return false
+	}
+	if strings.HasPrefix(r.Pattern, "*.") {
+		return strings.HasSuffix(name, r.Pattern[1:])
+	}
+	return r.Pattern == name
+}
+
+// ParsePolicyRule parses rule "<allow|block> <host|onion> <pattern>".
+func ParsePolicyRule(line, source string) (PolicyRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return PolicyRule{}, fmt.Errorf("%s: expected 3 fields in rule %q", source, line)
+	}
+	rule := PolicyRule{Action: fields[0], Kind: fields[1], Source: source}
+	if rule.Action != "allow" && rule.Action != "block" {
+		return rule, fmt.Errorf("%s: unknown action %q", source, rule.Action)
+	}
+	switch rule.Kind {
+	case "host":
+		prefix := ""
+		host := fields[2]
+		if strings.HasPrefix(host, "*.") {
+			prefix = "*."
+			host = host[len(prefix):]
+		}
+		host, err := NormalizeHostname(host)
+		if err != nil {
+			return rule, fmt.Errorf("%s: %s", source, err)
+		}
+		rule.Pattern = prefix + host
+	case "onion":
+		rule.Pattern = strings.ToLower(fields[2])
+		if !onionRegexp.MatchString(rule.Pattern) {
+			return rule, fmt.Errorf("%s: bad onion address %q", source, fields[2])
+		}
+	default:
+		return rule, fmt.Errorf("%s: unknown kind %q", source, rule.Kind)
+	}
+	return rule, nil
+}
+
+// LoadPolicyFile reads rules from file, one rule per line.
+// Empty lines and lines starting with "#" are ignored.
+func LoadPolicyFile(filename string) ([]PolicyRule, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules []PolicyRule
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", filename, lineNumber)
+		rule, err := ParsePolicyRule(line, source)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// Policy decides which hosts and onions may be proxied.
+// Block rules win over allow rules. If there are allow rules
+// of some kind, names of that kind not matching them are blocked.
+type Policy struct {
+	files []string
+
+	mutex sync.RWMutex
+	sets  map[string][]PolicyRule
+}
+
+// NewPolicy loads rules from files.
+func NewPolicy(files ...string) (*Policy, error) {
+	p := &Policy{
+		files: files,
+		sets:  make(map[string][]PolicyRule),
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload re-reads the files. On error the old rules are kept.
+func (p *Policy) Reload() error {
+	sets := make(map[string][]PolicyRule)
+	for _, filename := range p.files {
+		rules, err := LoadPolicyFile(filename)
+		if err != nil {
+			return err
+		}
+		sets[filename] = rules
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name, rules := range sets {
+		p.sets[name] = rules
+	}
+	return nil
+}
+
+// SetRules replaces set of rules with given name.
+func (p *Policy) SetRules(name string, rules []PolicyRule) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.sets[name] = rules
+}
+
+// check returns if name of kind is allowed and the deciding rule
+// (nil if no rule is involved).
+func (p *Policy) check(kind, name string) (bool, *PolicyRule) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var allowRule *PolicyRule
+	hasAllowRules := false
+	for _, rules := range p.sets {
+		for i := range rules {
+			rule := &rules[i]
+			if rule.Kind != kind {
+				continue
+			}
+			if rule.Action == "block" && rule.matches(kind, name) {
+				return false, rule
+			}
+			if rule.Action == "allow" {
+				hasAllowRules = true
+				if allowRule == nil && rule.matches(kind, name) {
+					allowRule = rule
+				}
+			}
+		}
+	}
+	if hasAllowRules && allowRule == nil {
+		return false, nil
+	}
+	return true, allowRule
+}
+
+// Check checks name of kind ("host" or "onion") and logs the decision.
+func (p *Policy) Check(kind, name string) error {
+	allowed, rule := p.check(kind, name)
+	if allowed {
+		if rule != nil {
+			log.Printf("Policy: %s %s allowed by rule %s", kind, name, rule)
+		}
+		return nil
+	}
+	if rule == nil {
+		log.Printf("Policy: %s %s blocked, not in allowlist", kind, name)
+		return newResolveError(PolicyDenied, "%s %s is not in allowlist", kind, name)
+	}
+	log.Printf("Policy: %s %s blocked by rule %s", kind, name, rule)
+	return newResolveError(PolicyDenied, "%s %s is blocked by rule %s", kind, name, rule)
+}
+
+// CheckTargets returns targets with allowed onions, or error
+// if no onion is allowed.
+func (p *Policy) CheckTargets(targets []OnionTarget) ([]OnionTarget, error) {
+	var allowed []OnionTarget
+	var err error
+	for _, target := range targets {
+		err = p.Check("onion", target.Onion)
+		if err == nil {
+			allowed = append(allowed, target)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, err
+	}
+	return allowed, nil
+}
+
+// PolicyResolver is a decorator which applies Policy to hosts
+// before resolution and to onions they resolve to.
+type PolicyResolver struct {
+	resolver HostToOnionResolver
+	policy   *Policy
+}
+
+func NewPolicyResolver(resolver HostToOnionResolver, policy *Policy) *PolicyResolver {
+	return &PolicyResolver{
+		resolver: resolver,
+		policy:   policy,
+	}
+}
+
+func (r *PolicyResolver) ResolveToTargets(hostname string) ([]OnionTarget, error) {
+	if err := r.policy.Check("host", normalizeDomain(hostname)); err != nil {
+		return nil, err
+	}
+	targets, err := ResolveTargets(r.resolver, hostname)
+	if err != nil {
+		return nil, err
+	}
+	return r.policy.CheckTargets(targets)
+}
+
+func (r *PolicyResolver) ResolveToOnion(hostname string) (string, error) {
+	targets, err := r.ResolveToTargets(hostname)
+	if err != nil {
+		return "", err
+	}
+	return targets[0].Onion, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func writePolicyFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %s", err)
+	}
+	file.WriteString(content)
+	file.Close()
+	return file.Name()
+}
+
+func TestPolicyBlocklist(t *testing.T) {
+	filename := writePolicyFile(t, `
+# abuse complaints
+block host *.evil.com
+block host Bad.Example.com.
+block onion t3mny6lhnyku4wrd.onion
+`)
+	defer os.Remove(filename)
+	policy, err := NewPolicy(filename)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %s", err)
+	}
+	for _, host := range []string{"example.com", "evil.com", "notevil.com"} {
+		if err := policy.Check("host", host); err != nil {
+			t.Errorf("Host %s was blocked: %s", host, err)
+		}
+	}
+	for _, host := range []string{"www.evil.com", "bad.example.com"} {
+		err := policy.Check("host", host)
+		checkErrorKind(t, host, err, PolicyDenied)
+	}
+	err = policy.Check("onion", "t3mny6lhnyku4wrd.onion")
+	checkErrorKind(t, "blocked onion", err, PolicyDenied)
+}
+
+func TestPolicyAllowlist(t *testing.T) {
+	filename := writePolicyFile(t, `
+allow host *.pasta.cf
+allow host pasta.cf
+block host private.pasta.cf
+`)
+	defer os.Remove(filename)
+	policy, err := NewPolicy(filename)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %s", err)
+	}
+	for _, host := range []string{"pasta.cf", "www.pasta.cf"} {
+		if err := policy.Check("host", host); err != nil {
+			t.Errorf("Host %s was blocked: %s", host, err)
+		}
+	}
+	for _, host := range []string{"example.com", "private.pasta.cf"} {
+		err := policy.Check("host", host)
+		checkErrorKind(t, host, err, PolicyDenied)
+	}
+	// no onion allow rules, so all onions are allowed
+	if err := policy.Check("onion", "t3mny6lhnyku4wrd.onion"); err != nil {
+		t.Errorf("Onion was blocked: %s", err)
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	filename := writePolicyFile(t, "block host example.com\n")
+	defer os.Remove(filename)
+	policy, err := NewPolicy(filename)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %s", err)
+	}
+	ioutil.WriteFile(filename, []byte("block host example.org\n"), 0600)
+	if err := policy.Reload(); err != nil {
+		t.Fatalf("Failed to reload: %s", err)
+	}
+	if err := policy.Check("host", "example.com"); err != nil {
+		t.Errorf("Old rule is still applied: %s", err)
+	}
+	if err := policy.Check("host", "example.org"); err == nil {
+		t.Errorf("New rule is not applied")
+	}
+	ioutil.WriteFile(filename, []byte("block everything\n"), 0600)
+	if err := policy.Reload(); err == nil {
+		t.Fatalf("Bad policy was loaded")
+	}
+	if err := policy.Check("host", "example.org"); err == nil {
+		t.Errorf("Rules were lost after failed reload")
+	}
+}
+
+func TestBadPolicyRules(t *testing.T) {
+	for _, line := range []string{
+		"block",
+		"deny host example.com",
+		"block url example.com",
+		"block onion example.com",
+		"block host exa mple.com",
+		"block host -example.com",
+	} {
+		if _, err := ParsePolicyRule(line, "test"); err == nil {
+			t.Errorf("Rule %q was accepted", line)
+		}
+	}
+}
+
+func TestPolicyResolver(t *testing.T) {
+	policy, err := NewPolicy()
+	if err != nil {
+		t.Fatalf("Failed to create policy: %s", err)
+	}
+	rule, _ := ParsePolicyRule("block onion pastagdsp33j7aoq.onion", "test")
+	policy.SetRules("test", []PolicyRule{rule})
+	resolver := NewPolicyResolver(MockOnionResolver("pastagdsp33j7aoq.onion"), policy)
+	_, err = resolver.ResolveToOnion("pasta.cf")
+	checkErrorKind(t, "blocked onion", err, PolicyDenied)
+	policy.SetRules("test", nil)
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err != nil {
+		t.Errorf("Failed to resolve: %s", err)
+	}
+}
+
+func TestBlockedConnectionGetsAlert(t *testing.T) {
+	policy, _ := NewPolicy()
+	rule, _ := ParsePolicyRule("block host horse25519", "test")
+	policy.SetRules("test", []PolicyRule{rule})
+	resolver := NewPolicyResolver(MockOnionResolver("pastagdsp33j7aoq.onion"), policy)
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", resolver)
+	proxy.sniParser = MockSNIParser{}
+	clientConn, proxyConn := net.Pipe()
+	go proxy.ProcessRequest(proxyConn)
+	alert, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+	want := []byte{recordTypeAlert, 3, 1, 0, 2, alertLevelFatal, alertAccessDenied}
+	if string(alert) != string(want) {
+		t.Fatalf("Got %v, expected alert %v", alert, want)
+	}
+}
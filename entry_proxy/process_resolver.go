@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// maxQueuedRequests is the number of requests waiting to be written to
+// the helper after which new requests fail.
+const maxQueuedRequests = 64
+
+// ProcessResolver delegates resolution to a helper executable.
+//
+// The helper reads requests from stdin and writes responses to stdout,
+// one JSON object per line. Requests are {"id": 1, "host": "example.com"}.
+// Responses carry the id of the request and either targets:
+//
+//	{"id": 1, "targets": [{"onion": "....onion", "port": 443}]}
+//
+// or an error with optional kind ("not found", "temporary failure",
+// "invalid record" or "policy denied"):
+//
+//	{"id": 1, "error": "unknown host", "kind": "not found"}
+//
+// Requests may be answered in any order. The helper is restarted
+// if it exits, and killed and restarted if it does not answer in time.
+type ProcessResolver struct {
+	command      string
+	args         []string
+	timeout      time.Duration
+	restartDelay time.Duration
+
+	mutex     sync.Mutex
+	cmd       *exec.Cmd
+	queue     chan []byte
+	pending   map[uint64]chan processResponse
+	nextID    uint64
+	lastStart time.Time
+}
+
+type processRequest struct {
+	ID   uint64 `json:"id"`
+	Host string `json:"host"`
+}
+
+type processTarget struct {
+	Onion    string `json:"onion"`
+	Port     int    `json:"port"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+}
+
+type processResponse struct {
+	ID      uint64          `json:"id"`
+	Targets []processTarget `json:"targets"`
+	Error   string          `json:"error"`
+	Kind    string          `json:"kind"`
+}
+
+func NewProcessResolver(timeout time.Duration, command string, args ...string) *ProcessResolver {
+	return &ProcessResolver{
+		command:      command,
+		args:         args,
+		timeout:      timeout,
+		restartDelay: time.Second,
+	}
+}
+
+// start runs the helper. Must be called with mutex held.
+func (r *ProcessResolver) start() error {
+	if since := time.Since(r.lastStart); since < r.restartDelay {
+		return fmt.Errorf("Helper %s was restarted %s ago", r.command, since)
+	}
+	r.lastStart = time.Now()
+	cmd := exec.Command(r.command, r.args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Unable to start helper %s: %s", r.command, err)
+	}
+	log.Printf("Started resolver helper %s (pid %d)", r.command, cmd.Process.Pid)
+	r.cmd = cmd
+	r.queue = make(chan []byte, maxQueuedRequests)
+	r.pending = make(map[uint64]chan processResponse)
+	go r.writeLoop(stdin, r.queue)
+	go r.readLoop(cmd, stdin, stdout, r.queue, r.pending)
+	return nil
+}
+
+// writeLoop writes queued requests to the helper. Writing blocks if the
+// helper does not read them, so it must not happen with mutex held.
+func (r *ProcessResolver) writeLoop(stdin io.Writer, queue chan []byte) {
+	for data := range queue {
+		if _, err := stdin.Write(data); err != nil {
+			log.Printf("Unable to write to resolver helper %s: %s", r.command, err)
+			break
+		}
+	}
+	// drop requests queued until readLoop closes the queue
+	for range queue {
+	}
+}
+
+// readLoop dispatches responses of the helper until it exits.
+func (r *ProcessResolver) readLoop(
+	cmd *exec.Cmd,
+	stdin io.WriteCloser,
+	stdout io.Reader,
+	queue chan []byte,
+	pending map[uint64]chan processResponse,
+) {
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var response processResponse
+		if err := json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			log.Printf("Bad response from resolver helper %s: %s", r.command, err)
+			continue
+		}
+		r.mutex.Lock()
+		reply, ok := pending[response.ID]
+		delete(pending, response.ID)
+		r.mutex.Unlock()
+		if ok {
+			reply <- response
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Unable to read from resolver helper %s: %s", r.command, err)
+	}
+	// the helper may still run if its output is broken
+	cmd.Process.Kill()
+	stdin.Close()
+	err := cmd.Wait()
+	log.Printf("Resolver helper %s exited: %v", r.command, err)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.cmd == cmd {
+		r.cmd = nil
+		r.queue = nil
+	}
+	close(queue)
+	for id, reply := range pending {
+		delete(pending, id)
+		reply <- processResponse{
+			ID:    id,
+			Error: "resolver helper exited",
+			Kind:  TemporaryFailure.String(),
+		}
+	}
+}
+
+// send writes request to the helper, starting it if needed.
+// It returns the helper the request was sent to.
+func (r *ProcessResolver) send(host string) (uint64, chan processResponse, *exec.Cmd, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.cmd == nil {
+		if err := r.start(); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	r.nextID++
+	id := r.nextID
+	data, err := json.Marshal(processRequest{ID: id, Host: host})
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	select {
+	case r.queue <- append(data, '\n'):
+	default:
+		return 0, nil, nil, fmt.Errorf("Helper %s does not read requests", r.command)
+	}
+	reply := make(chan processResponse, 1)
+	r.pending[id] = reply
+	return id, reply, r.cmd, nil
+}
+
+// restart kills the helper which did not answer in time, unless it was
+// already replaced. Requests pending on it fail and the next request
+// starts a new helper.
+func (r *ProcessResolver) restart(cmd *exec.Cmd) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.cmd != cmd {
+		return
+	}
+	log.Printf("Resolver helper %s does not answer, killing it", r.command)
+	cmd.Process.Kill()
+	r.cmd = nil
+	r.queue = nil
+}
+
+func parseResolveErrorKind(name string) ResolveErrorKind {
+	for _, kind := range []ResolveErrorKind{NotFound, InvalidRecord, PolicyDenied} {
+		if name == kind.String() {
+			return kind
+		}
+	}
+	return TemporaryFailure
+}
+
+func (r *ProcessResolver) ResolveToTargets(hostname string) ([]OnionTarget, error) {
+	_, reply, cmd, err := r.send(hostname)
+	if err != nil {
+		return nil, newResolveError(TemporaryFailure, "Resolver helper failed: %s", err)
+	}
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	var response processResponse
+	select {
+	case response = <-reply:
+	case <-timer.C:
+		r.restart(cmd)
+		return nil, newResolveError(TemporaryFailure, "Resolver helper timed out on %s", hostname)
+	}
+	if response.Error != "" {
+		return nil, newResolveError(parseResolveErrorKind(response.Kind), "%s", response.Error)
+	}
+	if len(response.Targets) == 0 {
+		return nil, newResolveError(NotFound, "Resolver helper returned no onions for %s", hostname)
+	}
+	var targets []OnionTarget
+	for _, target := range response.Targets {
+		if !onionRegexp.MatchString(target.Onion) || target.Port < 0 || target.Port > 65535 ||
+			target.Priority < 0 || target.Priority > 65535 ||
+			target.Weight < 0 || target.Weight > 65535 {
+			return nil, newResolveError(InvalidRecord, "Resolver helper returned bad target %v", target)
+		}
+		targets = append(targets, OnionTarget{
+			Onion:    target.Onion,
+			Port:     target.Port,
+			Priority: target.Priority,
+			Weight:   target.Weight,
+		})
+	}
+	OrderTargets(targets, nil)
+	return targets, nil
+}
+
+func (r *ProcessResolver) ResolveToOnion(hostname string) (string, error) {
+	targets, err := r.ResolveToTargets(hostname)
+	if err != nil {
+		return "", err
+	}
+	return targets[0].Onion, nil
+}
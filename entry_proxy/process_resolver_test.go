@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestResolverHelperProcess is not a real test: it is the helper
+// executable run by ProcessResolver in tests below.
+func TestResolverHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	mode := os.Args[len(os.Args)-1]
+	if mode == "deaf" {
+		// never read requests, so that writes to stdin block
+		select {}
+	}
+	var requests []processRequest
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var request processRequest
+		json.Unmarshal(scanner.Bytes(), &request)
+		response := processResponse{ID: request.ID}
+		switch {
+		case mode == "crash":
+			os.Exit(1)
+		case mode == "silent":
+			continue
+		case mode == "hang" && request.Host == "hang.com":
+			select {}
+		case mode == "long line":
+			fmt.Printf("%s\n", make([]byte, bufio.MaxScanTokenSize))
+			select {}
+		case mode == "bad weight":
+			response.Targets = []processTarget{{Onion: "pastagdsp33j7aoq.onion", Weight: -5}}
+		case request.Host == "unknown.com":
+			response.Error = "unknown host"
+			response.Kind = "not found"
+		default:
+			response.Targets = []processTarget{{Onion: "pastagdsp33j7aoq.onion", Port: 8443}}
+		}
+		if mode == "reversed" {
+			// answer pairs of requests in reverse order
+			requests = append(requests, request)
+			if len(requests) < 2 {
+				continue
+			}
+			for i := len(requests) - 1; i >= 0; i-- {
+				response.ID = requests[i].ID
+				data, _ := json.Marshal(response)
+				fmt.Printf("%s\n", data)
+			}
+			requests = nil
+			continue
+		}
+		data, _ := json.Marshal(response)
+		fmt.Printf("%s\n", data)
+	}
+	os.Exit(0)
+}
+
+func makeProcessResolver(t *testing.T, mode string) *ProcessResolver {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	resolver := NewProcessResolver(
+		time.Second,
+		os.Args[0],
+		"-test.run=TestResolverHelperProcess",
+		"--",
+		mode,
+	)
+	resolver.restartDelay = 0
+	return resolver
+}
+
+func TestProcessResolver(t *testing.T) {
+	resolver := makeProcessResolver(t, "normal")
+	targets, err := resolver.ResolveToTargets("example.com")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	want := OnionTarget{Onion: "pastagdsp33j7aoq.onion", Port: 8443}
+	if len(targets) != 1 || targets[0] != want {
+		t.Fatalf("Got %v, expected %v", targets, want)
+	}
+	_, err = resolver.ResolveToOnion("unknown.com")
+	checkErrorKind(t, "unknown host", err, NotFound)
+}
+
+func TestProcessResolverConcurrent(t *testing.T) {
+	resolver := makeProcessResolver(t, "reversed")
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := resolver.ResolveToOnion("example.com"); err != nil {
+				t.Errorf("Failed to resolve: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestProcessResolverCrash(t *testing.T) {
+	resolver := makeProcessResolver(t, "crash")
+	for i := 0; i < 2; i++ {
+		// the helper must be restarted after each crash
+		_, err := resolver.ResolveToOnion("example.com")
+		checkErrorKind(t, "crash", err, TemporaryFailure)
+	}
+}
+
+func TestProcessResolverTimeout(t *testing.T) {
+	resolver := makeProcessResolver(t, "silent")
+	resolver.timeout = 100 * time.Millisecond
+	_, err := resolver.ResolveToOnion("example.com")
+	checkErrorKind(t, "timeout", err, TemporaryFailure)
+}
+
+func TestProcessResolverRestartAfterTimeout(t *testing.T) {
+	resolver := makeProcessResolver(t, "hang")
+	resolver.timeout = 100 * time.Millisecond
+	_, err := resolver.ResolveToOnion("hang.com")
+	checkErrorKind(t, "timeout", err, TemporaryFailure)
+	// the hung helper must be replaced
+	if _, err := resolver.ResolveToOnion("example.com"); err != nil {
+		t.Fatalf("Failed to resolve after timeout: %s", err)
+	}
+}
+
+func TestProcessResolverNotReading(t *testing.T) {
+	resolver := makeProcessResolver(t, "deaf")
+	resolver.timeout = 100 * time.Millisecond
+	// requests larger than pipe buffer block writes to the helper
+	host := strings.Repeat("a", 32*1024) + ".com"
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := resolver.ResolveToOnion(host)
+				checkErrorKind(t, "not reading", err, TemporaryFailure)
+			}()
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Requests hang when the helper does not read them")
+	}
+}
+
+func TestProcessResolverLongLine(t *testing.T) {
+	resolver := makeProcessResolver(t, "long line")
+	resolver.timeout = 10 * time.Second
+	start := time.Now()
+	_, err := resolver.ResolveToOnion("example.com")
+	checkErrorKind(t, "long line", err, TemporaryFailure)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Request failed after %s, expected the helper to be killed", elapsed)
+	}
+}
+
+func TestProcessResolverBadWeight(t *testing.T) {
+	resolver := makeProcessResolver(t, "bad weight")
+	_, err := resolver.ResolveToOnion("example.com")
+	checkErrorKind(t, "bad weight", err, InvalidRecord)
+}
+
+func TestProcessResolverMissingCommand(t *testing.T) {
+	resolver := NewProcessResolver(time.Second, "/nonexistent/helper")
+	_, err := resolver.ResolveToOnion("example.com")
+	checkErrorKind(t, "missing command", err, TemporaryFailure)
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"io"
+	"context"
+	"errors"
 	"log"
 	"net"
 	"strconv"
-	"sync"
+	"time"
 
-	"github.com/polvi/sni"
 	"golang.org/x/net/proxy"
 )
 
@@ -15,21 +15,51 @@ type SNIParser interface {
 	ServerNameFromConn(c net.Conn) (string, net.Conn, error)
 }
 
-type RealSNIParser struct{}
+// ClientHelloParser is implemented by SNI parsers which provide
+// the rest of ClientHello too.
+type ClientHelloParser interface {
+	ClientHelloFromConn(c net.Conn) (*ClientHello, net.Conn, error)
+}
+
+// RealSNIParser reads server name from ClientHello of the client.
+// MaxSize limits the size of ClientHello (0 means the default).
+type RealSNIParser struct {
+	MaxSize int
+}
+
+func (t RealSNIParser) ClientHelloFromConn(clientConn net.Conn) (*ClientHello, net.Conn, error) {
+	maxSize := t.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxClientHelloSize
+	}
+	return ReadClientHello(clientConn, maxSize)
+}
 
 func (t RealSNIParser) ServerNameFromConn(clientConn net.Conn) (string, net.Conn, error) {
-	hostname, clientConn, err := sni.ServerNameFromConn(clientConn)
-	return hostname, clientConn, err
+	hello, clientConn, err := t.ClientHelloFromConn(clientConn)
+	if err != nil {
+		return "", nil, err
+	}
+	return hello.ServerName, clientConn, nil
 }
 
 type ProxyDialer interface {
 	Dial(string) (net.Conn, error)
 }
 
+// IsolatingDialer is implemented by dialers which can put connections
+// with different isolation tags on different Tor circuits.
+type IsolatingDialer interface {
+	DialIsolated(targetServer, isolation string) (net.Conn, error)
+}
+
 type SocksDialer struct {
 	proxyNet  string
 	proxyAddr string
 	auth      proxy.Auth
+
+	// forward connects to Tor.
+	forward proxy.Dialer
 }
 
 func NewSocksDialer(proxyNet, proxyAddr string) *SocksDialer {
@@ -40,12 +70,27 @@ func NewSocksDialer(proxyNet, proxyAddr string) *SocksDialer {
 			User:     "",
 			Password: "",
 		},
+		forward: proxy.Direct,
 	}
 	return &s
 }
 
 func (t *SocksDialer) Dial(targetServer string) (net.Conn, error) {
-	dialer, err := proxy.SOCKS5(t.proxyNet, t.proxyAddr, &t.auth, proxy.Direct)
+	return t.dial(targetServer, &t.auth)
+}
+
+// DialIsolated uses isolation tag as SOCKS username and password,
+// so Tor (with IsolateSOCKSAuth) uses separate circuits for it.
+func (t *SocksDialer) DialIsolated(targetServer, isolation string) (net.Conn, error) {
+	auth := proxy.Auth{
+		User:     isolation,
+		Password: isolation,
+	}
+	return t.dial(targetServer, &auth)
+}
+
+func (t *SocksDialer) dial(targetServer string, auth *proxy.Auth) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5(t.proxyNet, t.proxyAddr, auth, t.forward)
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +98,9 @@ func (t *SocksDialer) Dial(targetServer string) (net.Conn, error) {
 	return connection, err
 }
 
+// DefaultHandshakeTimeout limits time clients have to send ClientHello.
+const DefaultHandshakeTimeout = 10 * time.Second
+
 type TLSProxy struct {
 	conn      net.Conn
 	onionPort int
@@ -64,6 +112,38 @@ type TLSProxy struct {
 	resolver  HostToOnionResolver
 	dialer    ProxyDialer
 	listener  net.Listener
+
+	// workers (if not 0) limits number of connections processed at once;
+	// up to queueDepth connections wait for a worker, others are closed.
+	workers    int
+	queueDepth int
+	shed       int64
+
+	// handshakeTimeout limits time of reading ClientHello (0 for no limit).
+	handshakeTimeout time.Duration
+
+	// clientOptions are applied to the listener and client connections.
+	clientOptions SocketOptions
+
+	// buffers are used to copy streams which can not be spliced.
+	buffers *BufferPool
+
+	// noSNIRouter (optional) handles clients sending no SNI.
+	noSNIRouter *NoSNIRouter
+
+	// echRouter (optional) handles clients using Encrypted ClientHello.
+	echRouter *ECHRouter
+
+	// alpnRouter (optional) changes targets by ALPN of the client.
+	alpnRouter *ALPNRouter
+
+	// policy (optional) checks onions chosen by routers above, which do
+	// not pass through PolicyResolver.
+	policy *Policy
+
+	// errorPage (optional) is shown instead of TLS alert when
+	// the onion can not be reached.
+	errorPage *ErrorPage
 }
 
 func NewTLSProxy(
@@ -72,32 +152,59 @@ func NewTLSProxy(
 	resolver HostToOnionResolver,
 ) *TLSProxy {
 	t := TLSProxy{
-		onionPort: onionPort,
-		proxyNet:  proxyNet,
-		proxyAddr: proxyAddr,
-		sniParser: RealSNIParser{},
-		resolver:  resolver,
-		dialer:    NewSocksDialer(proxyNet, proxyAddr),
+		onionPort:        onionPort,
+		proxyNet:         proxyNet,
+		proxyAddr:        proxyAddr,
+		sniParser:        RealSNIParser{},
+		resolver:         resolver,
+		dialer:           NewSocksDialer(proxyNet, proxyAddr),
+		handshakeTimeout: DefaultHandshakeTimeout,
+		buffers:          NewBufferPool(DefaultBufferSize, 0),
 	}
 	return &t
 }
 
 func (t *TLSProxy) Listen(listenNet, listenAddr string) {
-	listener, err := net.Listen(listenNet, listenAddr)
+	listenConfig := t.clientOptions.ListenConfig()
+	listener, err := listenConfig.Listen(context.Background(), listenNet, listenAddr)
 	t.listener = listener
 	if err != nil {
 		log.Fatalf("Unable to listen on %s %s: %s", listenNet, listenAddr, err)
 	}
 }
 
+// Start accepts connections until the listener is closed. Accept errors
+// are retried with exponential backoff. If workers are configured,
+// connections are processed by them and shed when the queue is full.
 func (t *TLSProxy) Start() {
+	handle := func(conn net.Conn) {
+		go t.ProcessRequest(conn)
+	}
+	if t.workers > 0 {
+		queue := t.startWorkers()
+		defer close(queue)
+		handle = func(conn net.Conn) {
+			t.enqueue(queue, conn)
+		}
+	}
+	var delay time.Duration
 	for {
 		conn, err := t.listener.Accept()
 		if err == nil {
-			go t.ProcessRequest(conn)
-		} else {
-			log.Printf("Unable to accept request: %s", err)
+			delay = 0
+			if err := t.clientOptions.apply(conn); err != nil {
+				log.Printf("Unable to set socket options of %s: %s", conn.RemoteAddr(), err)
+			}
+			handle(conn)
+			continue
 		}
+		if errors.Is(err, net.ErrClosed) {
+			log.Printf("Listener %s is closed, no more requests are accepted", t.listener.Addr())
+			return
+		}
+		delay = nextAcceptDelay(delay)
+		log.Printf("Unable to accept request: %s; retrying in %s", err, delay)
+		time.Sleep(delay)
 	}
 }
 
@@ -105,36 +212,130 @@ func (t *TLSProxy) Addr() net.Addr {
 	return t.listener.Addr()
 }
 
+// readClientHello uses ClientHelloParser if sniParser implements it.
+func (t *TLSProxy) readClientHello(clientConn net.Conn) (*ClientHello, net.Conn, error) {
+	if parser, ok := t.sniParser.(ClientHelloParser); ok {
+		return parser.ClientHelloFromConn(clientConn)
+	}
+	hostname, clientConn, err := t.sniParser.ServerNameFromConn(clientConn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &ClientHello{ServerName: hostname}, clientConn, nil
+}
+
+// allChecked returns if onions of all targets are in checked.
+func allChecked(targets []OnionTarget, checked []string) bool {
+	for _, target := range targets {
+		if !contains(checked, target.Onion) {
+			return false
+		}
+	}
+	return true
+}
+
 func (t *TLSProxy) ProcessRequest(clientConn net.Conn) {
 	defer clientConn.Close()
-	hostname, clientConn, err := t.sniParser.ServerNameFromConn(clientConn)
+	if t.handshakeTimeout > 0 {
+		clientConn.SetReadDeadline(time.Now().Add(t.handshakeTimeout))
+	}
+	recorder := &helloRecorder{Conn: clientConn}
+	hello, clientConn, err := t.readClientHello(recorder)
 	if err != nil {
 		log.Printf("Unable to get target server name from SNI: %s", err)
+		sendTLSAlert(recorder, recorder.recordVersion(), alertHandshakeFailure)
 		return
 	}
-	onion, err := t.resolver.ResolveToOnion(hostname)
-	if err != nil {
-		log.Printf("Unable to resolve %s to onion: %s", hostname, err)
+	alert := func(description byte) {
+		sendTLSAlert(clientConn, recorder.recordVersion(), description)
+	}
+	var hostname string
+	var targets []OnionTarget
+	if hello.ServerName == "" && t.noSNIRouter != nil {
+		hostname, targets, err = t.noSNIRouter.Route(clientConn)
+		if err != nil {
+			alert(alertUnrecognizedName)
+			return
+		}
+	} else {
+		hostname, err = NormalizeHostname(hello.ServerName)
+		if err != nil {
+			log.Printf("Invalid server name in SNI: %s", err)
+			alert(alertUnrecognizedName)
+			return
+		}
+		if hello.ECH && t.echRouter != nil {
+			targets = t.echRouter.Route(hostname)
+		}
+	}
+	// onions checked by the policy while resolving
+	var checked []string
+	if targets == nil {
+		targets, err = ResolveTargets(t.resolver, hostname)
+		if err != nil {
+			kind := ResolveErrorKindOf(err)
+			log.Printf("Unable to resolve %s to onion (%s): %s", hostname, kind, err)
+			alert(resolveErrorAlert(kind))
+			return
+		}
+		for _, target := range targets {
+			checked = append(checked, target.Onion)
+		}
+	}
+	if t.alpnRouter != nil {
+		targets = t.alpnRouter.Apply(hostname, hello.ALPN, targets)
+	}
+	if t.policy != nil && !allChecked(targets, checked) {
+		targets, err = t.policy.CheckTargets(targets)
+		if err != nil {
+			log.Printf("Onion routed for %s is denied: %s", hostname, err)
+			alert(alertAccessDenied)
+			return
+		}
+	}
+	if len(targets) == 0 {
+		log.Printf("No onion targets for %s", hostname)
+		alert(alertUnrecognizedName)
 		return
 	}
-	log.Printf("%s was resolved to %s", hostname, onion)
-	targetServer := net.JoinHostPort(onion, strconv.Itoa(t.onionPort))
-	serverConn, err := t.dialer.Dial(targetServer)
-
-	if err != nil {
+	var serverConn net.Conn
+	var target OnionTarget
+	for _, target = range targets {
+		log.Printf("%s was resolved to %s", hostname, target.Onion)
+		port := target.Port
+		if port == 0 {
+			port = t.onionPort
+		}
+		targetServer := net.JoinHostPort(target.Onion, strconv.Itoa(port))
+		isolatingDialer, ok := t.dialer.(IsolatingDialer)
+		if ok && target.Isolation != "" {
+			serverConn, err = isolatingDialer.DialIsolated(targetServer, target.Isolation)
+		} else {
+			serverConn, err = t.dialer.Dial(targetServer)
+		}
+		if err == nil {
+			break
+		}
 		log.Printf("Unable to connect to %s through %s %s: %s\n", targetServer, t.proxyNet, t.proxyAddr, err)
+	}
+	if err != nil {
+		if t.errorPage != nil && t.errorPage.Covers(hostname) {
+			pageErr := t.errorPage.Serve(clientConn, ErrorPageData{
+				Host:   hostname,
+				Onion:  target.Onion,
+				Reason: errorPageReason(err),
+			})
+			if pageErr != nil {
+				log.Printf("Unable to serve error page for %s: %s", hostname, pageErr)
+			}
+			return
+		}
+		alert(alertInternalError)
 		return
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	copyLoop := func(dst, src net.Conn) {
-		defer wg.Done()
-		defer dst.Close()
-		io.Copy(dst, src)
+	clientConn.SetReadDeadline(time.Time{})
+	if err := pipe(clientConn, serverConn, t.buffers); err != nil {
+		log.Printf("Unable to send ClientHello of %s to onion: %s", hostname, err)
 	}
-	go copyLoop(clientConn, serverConn)
-	go copyLoop(serverConn, clientConn)
-	wg.Wait()
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ResolveErrorKind is the category of a resolution failure.
+type ResolveErrorKind int
+
+const (
+	// NotFound means the host is not configured.
+	NotFound ResolveErrorKind = iota
+	// TemporaryFailure means the lookup failed and may succeed later.
+	TemporaryFailure
+	// InvalidRecord means the host is configured with malformed data.
+	InvalidRecord
+	// PolicyDenied means the host is configured but must not be served.
+	PolicyDenied
+)
+
+func (k ResolveErrorKind) String() string {
+	switch k {
+	case NotFound:
+		return "not found"
+	case TemporaryFailure:
+		return "temporary failure"
+	case InvalidRecord:
+		return "invalid record"
+	case PolicyDenied:
+		return "policy denied"
+	}
+	return fmt.Sprintf("ResolveErrorKind(%d)", int(k))
+}
+
+// ResolveError is returned by resolvers of this package.
+type ResolveError struct {
+	Kind ResolveErrorKind
+	Err  error
+}
+
+func (e *ResolveError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+func newResolveError(kind ResolveErrorKind, format string, args ...interface{}) error {
+	return &ResolveError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// ResolveErrorKindOf returns category of err. Errors not produced by
+// resolvers of this package are reported as TemporaryFailure.
+func ResolveErrorKindOf(err error) ResolveErrorKind {
+	var resolveError *ResolveError
+	if errors.As(err, &resolveError) {
+		return resolveError.Kind
+	}
+	return TemporaryFailure
+}
+
+// lookupError converts error of DNS lookup to ResolveError.
+// NXDOMAIN is NotFound, timeouts and other failures are TemporaryFailure.
+func lookupError(err error) error {
+	var resolveError *ResolveError
+	if errors.As(err, &resolveError) {
+		return err
+	}
+	kind := TemporaryFailure
+	var dnsError *net.DNSError
+	if errors.As(err, &dnsError) {
+		switch {
+		case dnsError.IsNotFound:
+			kind = NotFound
+		case dnsError.IsTimeout, dnsError.IsTemporary:
+			kind = TemporaryFailure
+		}
+	}
+	return &ResolveError{Kind: kind, Err: err}
+}
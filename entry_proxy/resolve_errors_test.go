@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+type ErrorMockTxtResolver struct {
+	err error
+}
+
+func (o ErrorMockTxtResolver) LookupTXT(hostname string) ([]string, error) {
+	return nil, o.err
+}
+
+func checkErrorKind(t *testing.T, name string, err error, want ResolveErrorKind) {
+	if err == nil {
+		t.Errorf("%s: expected %s, got no error", name, want)
+		return
+	}
+	if kind := ResolveErrorKindOf(err); kind != want {
+		t.Errorf("%s: expected %s, got %s (%s)", name, want, kind, err)
+	}
+}
+
+func TestDnsResolverErrorKinds(t *testing.T) {
+	for name, c := range map[string]struct {
+		txtResolver TxtResolver
+		want        ResolveErrorKind
+	}{
+		"NXDOMAIN": {
+			ErrorMockTxtResolver{&net.DNSError{Err: "no such host", IsNotFound: true}},
+			NotFound,
+		},
+		"timeout": {
+			ErrorMockTxtResolver{&net.DNSError{Err: "i/o timeout", IsTimeout: true, IsTemporary: true}},
+			TemporaryFailure,
+		},
+		"wrapped NXDOMAIN": {
+			ErrorMockTxtResolver{fmt.Errorf("TXT lookup: %w", &net.DNSError{Err: "no such host", IsNotFound: true})},
+			NotFound,
+		},
+		"wrapped timeout": {
+			ErrorMockTxtResolver{fmt.Errorf("TXT lookup: %w", &net.DNSError{Err: "i/o timeout", IsTimeout: true})},
+			TemporaryFailure,
+		},
+		"SERVFAIL": {
+			ErrorMockTxtResolver{&net.DNSError{Err: "server misbehaving", IsTemporary: true}},
+			TemporaryFailure,
+		},
+		"other error": {
+			ErrorMockTxtResolver{errors.New("I always throw")},
+			TemporaryFailure,
+		},
+		"no TXT":       {EmptyMockTxtResolver{}, NotFound},
+		"no onion TXT": {NoOnionsMockTxtResolver{}, NotFound},
+		"malformed": {
+			StaticMockTxtResolver{"onion=pastagdsp33j7aoq.onion port=http"},
+			InvalidRecord,
+		},
+	} {
+		resolver := NewDnsHostToOnionResolver()
+		resolver.txtResolver = c.txtResolver
+		_, err := resolver.ResolveToOnion("example.com")
+		checkErrorKind(t, name, err, c.want)
+	}
+}
+
+func TestDnsResolverUnsignedErrorKind(t *testing.T) {
+	resolver := NewDnsHostToOnionResolver()
+	resolver.requireSignature = true
+	resolver.txtResolver = StaticMockTxtResolver{"onion=pastagdsp33j7aoq.onion"}
+	_, err := resolver.ResolveToOnion("example.com")
+	checkErrorKind(t, "unsigned", err, PolicyDenied)
+}
+
+func TestStaticResolverErrorKinds(t *testing.T) {
+	resolver, err := LoadStaticResolver([]byte(`
+host2onion:
+    "*.pasta.cf.": pastagdsp33j7aoq.onion
+    "!private.pasta.cf.": ""
+    old.pasta.cf.: {onion: pastagdsp33j7aoq.onion, enabled: false}
+`))
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	_, err = resolver.ResolveToOnion("example.com")
+	checkErrorKind(t, "missing", err, NotFound)
+	_, err = resolver.ResolveToOnion("private.pasta.cf")
+	checkErrorKind(t, "excluded", err, PolicyDenied)
+	_, err = resolver.ResolveToOnion("old.pasta.cf")
+	checkErrorKind(t, "disabled", err, PolicyDenied)
+}
+
+func TestSubdomainResolverErrorKind(t *testing.T) {
+	_, err := NewSubdomainResolver("example.com").ResolveToOnion("example.org")
+	checkErrorKind(t, "other domain", err, NotFound)
+}
+
+func TestDnsResolverConsent(t *testing.T) {
+	resolver := NewDnsHostToOnionResolver()
+	resolver.gatewayID = "gw2"
+	for _, txt := range []string{
+		"onion=pastagdsp33j7aoq.onion gateways=gw1,gw2",
+		"onion=pastagdsp33j7aoq.onion gateways=*",
+	} {
+		resolver.txtResolver = StaticMockTxtResolver{txt}
+		if _, err := resolver.ResolveToOnion("example.com"); err != nil {
+			t.Errorf("Record %q was rejected: %s", txt, err)
+		}
+	}
+	for _, records := range [][]string{
+		{"onion=pastagdsp33j7aoq.onion"},
+		{"onion=pastagdsp33j7aoq.onion gateways=gw1,gw22"},
+		{"onion=pastagdsp33j7aoq.onion gateways=gw1", "onion=pastagdsp33j7aoq.onion port=http"},
+		{"onion=pastagdsp33j7aoq.onion port=http", "onion=pastagdsp33j7aoq.onion gateways=gw1"},
+	} {
+		resolver.txtResolver = StaticMockTxtResolver(records)
+		_, err := resolver.ResolveToOnion("example.com")
+		checkErrorKind(t, records[0], err, PolicyDenied)
+	}
+	resolver.gatewayID = ""
+	resolver.txtResolver = StaticMockTxtResolver{"onion=pastagdsp33j7aoq.onion gateways=gw1"}
+	if _, err := resolver.ResolveToOnion("example.com"); err != nil {
+		t.Errorf("Consent was checked without gateway ID: %s", err)
+	}
+}
+
+func TestResolveErrorKindOfWrapped(t *testing.T) {
+	err := newResolveError(PolicyDenied, "blocked")
+	wrapped := fmt.Errorf("decorator: %w", err)
+	checkErrorKind(t, "wrapped", wrapped, PolicyDenied)
+	checkErrorKind(t, "lookup of wrapped", lookupError(wrapped), PolicyDenied)
+}
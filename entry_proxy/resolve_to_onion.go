@@ -1,11 +1,18 @@
 package main
 
 import (
-	"fmt"
 	"net"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DonnchaC/oniongateway/util"
 )
 
+// onionRegexp matches v2 and v3 onion addresses.
+var onionRegexp = regexp.MustCompile("^([a-z0-9]{16}|[a-z2-7]{56}).onion$")
+
 type TxtResolver interface {
 	LookupTXT(string) ([]string, error)
 }
@@ -24,29 +31,143 @@ type HostToOnionResolver interface {
 type DnsHostToOnionResolver struct {
 	regex       *regexp.Regexp
 	txtResolver TxtResolver
+	randIntn    func(n int) int
+	now         func() time.Time
+
+	// requireSignature makes the resolver skip records
+	// which are not signed by the key of the onion service.
+	requireSignature bool
+
+	// gatewayID enables consent mode: only records listing this
+	// gateway (or "*") in "gateways=" key are used.
+	gatewayID string
 }
 
 func NewDnsHostToOnionResolver() *DnsHostToOnionResolver {
 	return &DnsHostToOnionResolver{
 		txtResolver: RealTxtResolver{},
-		regex:       regexp.MustCompile("(^| )onion=([a-z0-9]{16}.onion)( |$)"),
+		regex:       onionRegexp,
+		now:         time.Now,
 	}
 }
 
-func (o *DnsHostToOnionResolver) ResolveToOnion(hostname string) (onion string, err error) {
+// parseRecord parses TXT record of the form
+// "onion=<addr> [port=<n>] [priority=<n>] [weight=<n>] [gateways=<id>,...]
+// [expires=<unix> sig=<base64>]".
+// Unknown keys are ignored. ok is false if the record has no onion key.
+// If the record is signed, the signature is verified.
+func (o *DnsHostToOnionResolver) parseRecord(hostname, txt string) (target OnionTarget, ok bool, err error) {
+	var expires, signature string
+	var gateways []string
+	for _, field := range strings.Fields(txt) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := parts[0], parts[1]
+		switch key {
+		case "onion":
+			if !o.regex.MatchString(value) {
+				return target, false, newResolveError(InvalidRecord, "Bad onion address %q", value)
+			}
+			target.Onion = value
+			ok = true
+		case "port":
+			target.Port, err = strconv.Atoi(value)
+			if err != nil || target.Port < 1 || target.Port > 65535 {
+				return target, false, newResolveError(InvalidRecord, "Bad port %q", value)
+			}
+		case "priority", "weight":
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 0 || number > 65535 {
+				return target, false, newResolveError(InvalidRecord, "Bad %s %q", key, value)
+			}
+			if key == "priority" {
+				target.Priority = number
+			} else {
+				target.Weight = number
+			}
+		case "expires":
+			expires = value
+		case "sig":
+			signature = value
+		case "gateways":
+			gateways = strings.Split(value, ",")
+		}
+	}
+	if !ok {
+		return target, false, nil
+	}
+	if signature != "" || expires != "" {
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return target, false, newResolveError(InvalidRecord, "Bad expiry time %q", expires)
+		}
+		err = util.VerifyBinding(
+			hostname,
+			target.Onion,
+			time.Unix(seconds, 0),
+			signature,
+			o.now(),
+		)
+		if err != nil {
+			return target, false, &ResolveError{Kind: InvalidRecord, Err: err}
+		}
+		target.Verified = true
+	}
+	if o.gatewayID != "" && !contains(gateways, o.gatewayID) && !contains(gateways, "*") {
+		return target, false, newResolveError(PolicyDenied, "Record does not authorize gateway %q", o.gatewayID)
+	}
+	if o.requireSignature && !target.Verified {
+		return target, false, newResolveError(PolicyDenied, "Record is not signed")
+	}
+	return target, true, nil
+}
+
+func (o *DnsHostToOnionResolver) ResolveToTargets(hostname string) ([]OnionTarget, error) {
 	txts, err := o.txtResolver.LookupTXT(hostname)
 	if err != nil {
-		return
+		return nil, lookupError(err)
 	}
 	if len(txts) == 0 {
-		err = fmt.Errorf("No TXT records for %s", hostname)
-		return
+		return nil, newResolveError(NotFound, "No TXT records for %s", hostname)
 	}
+	var targets []OnionTarget
+	var parseErr error
 	for _, txt := range txts {
-		match := o.regex.FindStringSubmatch(txt)
-		if match != nil {
-			return match[2], nil // the submatch we are interested in
+		target, ok, err := o.parseRecord(hostname, txt)
+		if err != nil {
+			if parseErr != nil && ResolveErrorKindOf(parseErr) == PolicyDenied {
+				// report that the host is denied rather than broken
+				continue
+			}
+			parseErr = newResolveError(
+				ResolveErrorKindOf(err),
+				"Unusable TXT record %q for %s: %s",
+				txt,
+				hostname,
+				err,
+			)
+			continue
+		}
+		if ok {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		if parseErr != nil {
+			return nil, parseErr
 		}
+		return nil, newResolveError(NotFound, "No suitable TXT records for %s", hostname)
+	}
+	OrderTargets(targets, o.randIntn)
+	return targets, nil
+}
+
+func (o *DnsHostToOnionResolver) ResolveToOnion(hostname string) (onion string, err error) {
+	targets, err := o.ResolveToTargets(hostname)
+	if err != nil {
+		return "", err
 	}
-	return "", fmt.Errorf("No suitable TXT records for %s", hostname)
+	return targets[0].Onion, nil
 }
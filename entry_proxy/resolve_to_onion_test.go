@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
 	"errors"
 	"testing"
+	"time"
+
+	"github.com/DonnchaC/oniongateway/util"
+	"golang.org/x/crypto/ed25519"
 )
 
 type EmptyMockTxtResolver struct{}
@@ -49,3 +54,132 @@ func TestThrowingMockTxtResolver(t *testing.T) {
 		t.Fatal("Throwing TXT resolver works, but it must not")
 	}
 }
+
+type StaticMockTxtResolver []string
+
+func (o StaticMockTxtResolver) LookupTXT(hostname string) ([]string, error) {
+	return o, nil
+}
+
+func TestBareOnionRecord(t *testing.T) {
+	resolver := NewDnsHostToOnionResolver()
+	resolver.txtResolver = StaticMockTxtResolver{"onion=pastagdsp33j7aoq.onion"}
+	targets, err := resolver.ResolveToTargets("example.com")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	want := OnionTarget{Onion: "pastagdsp33j7aoq.onion"}
+	if len(targets) != 1 || targets[0] != want {
+		t.Fatalf("Got %v, expected %v", targets, want)
+	}
+}
+
+func TestExtendedOnionRecords(t *testing.T) {
+	resolver := NewDnsHostToOnionResolver()
+	resolver.txtResolver = StaticMockTxtResolver{
+		"v=spf1 -all",
+		"onion=t3mny6lhnyku4wrd.onion port=8443 priority=20 weight=5",
+		"onion=pastagdsp33j7aoq.onion port=443 priority=10",
+	}
+	targets, err := resolver.ResolveToTargets("example.com")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	want := []OnionTarget{
+		{Onion: "pastagdsp33j7aoq.onion", Port: 443, Priority: 10},
+		{Onion: "t3mny6lhnyku4wrd.onion", Port: 8443, Priority: 20, Weight: 5},
+	}
+	if len(targets) != len(want) {
+		t.Fatalf("Got %v, expected %v", targets, want)
+	}
+	for i := range want {
+		if targets[i] != want[i] {
+			t.Fatalf("Got %v, expected %v", targets, want)
+		}
+	}
+	onion, err := resolver.ResolveToOnion("example.com")
+	if err != nil || onion != "pastagdsp33j7aoq.onion" {
+		t.Fatalf("ResolveToOnion returned %q, %v", onion, err)
+	}
+}
+
+func TestMalformedOnionRecords(t *testing.T) {
+	for _, txt := range []string{
+		"onion=pastagdsp33j7aoq.onion port=0",
+		"onion=pastagdsp33j7aoq.onion port=65536",
+		"onion=pastagdsp33j7aoq.onion priority=high",
+		"onion=pastagdsp33j7aoq.onion weight=-1",
+		"onion=notanonion port=443",
+	} {
+		resolver := NewDnsHostToOnionResolver()
+		resolver.txtResolver = StaticMockTxtResolver{txt}
+		if _, err := resolver.ResolveToTargets("example.com"); err == nil {
+			t.Errorf("Malformed record %q was accepted", txt)
+		}
+	}
+}
+
+func TestMalformedOnionRecordSkipped(t *testing.T) {
+	resolver := NewDnsHostToOnionResolver()
+	resolver.txtResolver = StaticMockTxtResolver{
+		"onion=pastagdsp33j7aoq.onion port=http",
+		"onion=t3mny6lhnyku4wrd.onion",
+	}
+	onion, err := resolver.ResolveToOnion("example.com")
+	if err != nil || onion != "t3mny6lhnyku4wrd.onion" {
+		t.Fatalf("ResolveToOnion returned %q, %v", onion, err)
+	}
+}
+
+func makeSignedRecord(t *testing.T, domain string, expires time.Time) (record, onion string) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	key := util.NewOnionSecretKey(privateKey)
+	return key.SignBinding(domain, expires), util.OnionAddressFromPublicKey(key.PublicKey())
+}
+
+func TestSignedOnionRecord(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	record, onion := makeSignedRecord(t, "example.com", now.Add(time.Hour))
+	resolver := NewDnsHostToOnionResolver()
+	resolver.now = func() time.Time { return now }
+	resolver.requireSignature = true
+	resolver.txtResolver = StaticMockTxtResolver{
+		"onion=pastagdsp33j7aoq.onion",
+		record,
+	}
+	targets, err := resolver.ResolveToTargets("example.com")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	if len(targets) != 1 || targets[0].Onion != onion || !targets[0].Verified {
+		t.Fatalf("Expected only verified %s, got %v", onion, targets)
+	}
+	if _, err := resolver.ResolveToTargets("example.org"); err == nil {
+		t.Fatalf("Record signed for example.com was accepted for example.org")
+	}
+	resolver.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if _, err := resolver.ResolveToTargets("example.com"); err == nil {
+		t.Fatalf("Expired record was accepted")
+	}
+}
+
+func TestUnsignedOnionRecordNotStrict(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	record, _ := makeSignedRecord(t, "example.org", now.Add(time.Hour))
+	resolver := NewDnsHostToOnionResolver()
+	resolver.now = func() time.Time { return now }
+	resolver.txtResolver = StaticMockTxtResolver{
+		"onion=pastagdsp33j7aoq.onion",
+		record,
+	}
+	targets, err := resolver.ResolveToTargets("example.com")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	if len(targets) != 1 || targets[0].Onion != "pastagdsp33j7aoq.onion" || targets[0].Verified {
+		t.Fatalf("Expected only unverified record, got %v", targets)
+	}
+}
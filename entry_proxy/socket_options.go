@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SocketOptions are TCP options of connections on one side of the proxy.
+// Zero values keep defaults of the system and of Go.
+type SocketOptions struct {
+	// KeepAliveIdle is idle time before the first keepalive probe,
+	// negative disables keepalives. Interval and count of probes
+	// can be set on Linux only.
+	KeepAliveIdle     time.Duration `yaml:"keepalive_idle"`
+	KeepAliveInterval time.Duration `yaml:"keepalive_interval"`
+	KeepAliveCount    int           `yaml:"keepalive_count"`
+
+	NoDelay     *bool         `yaml:"nodelay"`
+	UserTimeout time.Duration `yaml:"user_timeout"` // TCP_USER_TIMEOUT, Linux only
+	RecvBuffer  int           `yaml:"recv_buffer"`  // SO_RCVBUF
+	SendBuffer  int           `yaml:"send_buffer"`  // SO_SNDBUF
+
+	// FastOpen is the queue length of TCP_FASTOPEN of the listener
+	// (Linux only, client side only).
+	FastOpen int `yaml:"fastopen"`
+}
+
+// SocketConfig holds options of connections of clients
+// and of connections to Tor.
+type SocketConfig struct {
+	Client SocketOptions `yaml:"client"`
+	Tor    SocketOptions `yaml:"tor"`
+}
+
+// LoadSocketConfig reads SocketConfig from yaml file.
+func LoadSocketConfig(filename string) (*SocketConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := &SocketConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	if err := config.Client.validate(); err != nil {
+		return nil, fmt.Errorf("client: %s", err)
+	}
+	if err := config.Tor.validate(); err != nil {
+		return nil, fmt.Errorf("tor: %s", err)
+	}
+	return config, nil
+}
+
+// validate rejects values which the kernel would refuse on every
+// connection, or which would be truncated to 0 by setsockopt units.
+func (o SocketOptions) validate() error {
+	if o.KeepAliveInterval < 0 || (o.KeepAliveInterval > 0 && o.KeepAliveInterval < time.Second) {
+		return fmt.Errorf("keepalive_interval %s must be at least 1s", o.KeepAliveInterval)
+	}
+	if o.UserTimeout < 0 || (o.UserTimeout > 0 && o.UserTimeout < time.Millisecond) {
+		return fmt.Errorf("user_timeout %s must be at least 1ms", o.UserTimeout)
+	}
+	for name, value := range map[string]int{
+		"keepalive_count": o.KeepAliveCount,
+		"recv_buffer":     o.RecvBuffer,
+		"send_buffer":     o.SendBuffer,
+		"fastopen":        o.FastOpen,
+	} {
+		if value < 0 {
+			return fmt.Errorf("%s %d must not be negative", name, value)
+		}
+	}
+	return nil
+}
+
+func isTCP(network string) bool {
+	return network == "tcp" || network == "tcp4" || network == "tcp6"
+}
+
+// ListenConfig returns config of listener setting the options
+// on the listening socket. Accepted connections inherit most of them;
+// apply sets the rest.
+func (o SocketOptions) ListenConfig() *net.ListenConfig {
+	return &net.ListenConfig{
+		KeepAlive: o.KeepAliveIdle,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if !isTCP(network) {
+				return nil
+			}
+			return o.control(c, true)
+		},
+	}
+}
+
+// apply sets options on connected socket.
+func (o SocketOptions) apply(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.KeepAliveIdle < 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if o.KeepAliveIdle > 0 {
+		// sets interval too, so it is set by control below
+		if err := tcpConn.SetKeepAlivePeriod(o.KeepAliveIdle); err != nil {
+			return err
+		}
+	}
+	if o.NoDelay != nil {
+		if err := tcpConn.SetNoDelay(*o.NoDelay); err != nil {
+			return err
+		}
+	}
+	if o.RecvBuffer != 0 {
+		if err := tcpConn.SetReadBuffer(o.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	if o.SendBuffer != 0 {
+		if err := tcpConn.SetWriteBuffer(o.SendBuffer); err != nil {
+			return err
+		}
+	}
+	c, err := tcpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return o.control(c, false)
+}
+
+// OptionsDialer connects to Tor applying SocketOptions.
+// It is used as forward dialer of SOCKS client.
+type OptionsDialer struct {
+	dialer  net.Dialer
+	options SocketOptions
+}
+
+func NewOptionsDialer(options SocketOptions) *OptionsDialer {
+	return &OptionsDialer{
+		dialer: net.Dialer{
+			KeepAlive: options.KeepAliveIdle,
+			Control: func(network, address string, c syscall.RawConn) error {
+				if !isTCP(network) {
+					return nil
+				}
+				return options.control(c, false)
+			},
+		},
+		options: options,
+	}
+}
+
+func (d *OptionsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.options.apply(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *OptionsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Options missing in package syscall, same on all Linux architectures.
+const (
+	tcpUserTimeout = 0x12 // TCP_USER_TIMEOUT
+	tcpFastOpen    = 0x17 // TCP_FASTOPEN
+)
+
+// control sets options which need setsockopt on the socket c.
+// TCP_FASTOPEN is set only on listener. Go resets keepalive interval
+// when connection is established, so apply calls control again.
+func (o SocketOptions) control(c syscall.RawConn, listener bool) error {
+	var err error
+	setsockopt := func(fd uintptr, level, name, value int) {
+		if err == nil {
+			err = os.NewSyscallError("setsockopt", syscall.SetsockoptInt(int(fd), level, name, value))
+		}
+	}
+	controlErr := c.Control(func(fd uintptr) {
+		if o.RecvBuffer != 0 {
+			setsockopt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.RecvBuffer)
+		}
+		if o.SendBuffer != 0 {
+			setsockopt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer)
+		}
+		if o.UserTimeout != 0 {
+			setsockopt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, int(o.UserTimeout/time.Millisecond))
+		}
+		if o.KeepAliveInterval > 0 {
+			setsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, int(o.KeepAliveInterval/time.Second))
+		}
+		if o.KeepAliveCount > 0 {
+			setsockopt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, o.KeepAliveCount)
+		}
+		if listener && o.FastOpen != 0 {
+			setsockopt(fd, syscall.IPPROTO_TCP, tcpFastOpen, o.FastOpen)
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func getsockopt(t *testing.T, conn syscall.Conn, level, name int) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %s", err)
+	}
+	var value int
+	raw.Control(func(fd uintptr) {
+		value, err = syscall.GetsockoptInt(int(fd), level, name)
+	})
+	if err != nil {
+		t.Fatalf("getsockopt(%d, %d) failed: %s", level, name, err)
+	}
+	return value
+}
+
+var testNoDelay = false
+
+var testSocketOptions = SocketOptions{
+	KeepAliveIdle:     40 * time.Second,
+	KeepAliveInterval: 7 * time.Second,
+	KeepAliveCount:    4,
+	NoDelay:           &testNoDelay,
+	UserTimeout:       12 * time.Second,
+	RecvBuffer:        64 * 1024,
+	SendBuffer:        32 * 1024,
+	FastOpen:          16,
+}
+
+// checkSocketOptions checks testSocketOptions on connected socket.
+func checkSocketOptions(t *testing.T, side string, conn syscall.Conn) {
+	for _, c := range []struct {
+		name        string
+		level, opt  int
+		want, limit int // value must be in [want, limit]
+	}{
+		{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1, 1},
+		{"TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 40, 40},
+		{"TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 7, 7},
+		{"TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 4, 4},
+		{"TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0, 0},
+		{"TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, tcpUserTimeout, 12000, 12000},
+		// Linux doubles buffer sizes for bookkeeping
+		{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, 64 * 1024, 2 * 64 * 1024},
+		{"SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, 32 * 1024, 2 * 32 * 1024},
+	} {
+		if got := getsockopt(t, conn, c.level, c.opt); got < c.want || got > c.limit {
+			t.Errorf("%s: %s is %d, expected %d", side, c.name, got, c.want)
+		}
+	}
+}
+
+// CapturingSNIParser passes client connections to the test
+// and holds them until released.
+type CapturingSNIParser struct {
+	conns   chan net.Conn
+	release chan bool
+}
+
+func (p CapturingSNIParser) ServerNameFromConn(clientConn net.Conn) (string, net.Conn, error) {
+	_, raw := unwrapClientConn(clientConn)
+	p.conns <- raw
+	<-p.release
+	return "", nil, errors.New("released")
+}
+
+func TestClientSocketOptions(t *testing.T) {
+	parser := CapturingSNIParser{conns: make(chan net.Conn, 1), release: make(chan bool)}
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.sniParser = parser
+	proxy.clientOptions = testSocketOptions
+	proxy.Listen("tcp", "127.0.0.1:0")
+	defer proxy.listener.Close()
+	listener := proxy.listener.(*net.TCPListener)
+	if got := getsockopt(t, listener, syscall.IPPROTO_TCP, tcpFastOpen); got != 16 {
+		t.Errorf("TCP_FASTOPEN of listener is %d, expected 16", got)
+	}
+	go proxy.Start()
+	client, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %s", err)
+	}
+	defer client.Close()
+	conn := <-parser.conns
+	checkSocketOptions(t, "client", conn.(*net.TCPConn))
+	parser.release <- true
+}
+
+func TestTorSocketOptions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+	dialer := NewOptionsDialer(testSocketOptions)
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	checkSocketOptions(t, "Tor", conn.(*net.TCPConn))
+}
+
+// RecordingForwardDialer remembers address of Tor it dialed.
+type RecordingForwardDialer struct {
+	*OptionsDialer
+	dialed string
+}
+
+func (d *RecordingForwardDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialed = address
+	return d.OptionsDialer.DialContext(ctx, network, address)
+}
+
+func TestSocksDialerUsesForwardDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	dialer := NewSocksDialer("tcp", listener.Addr().String())
+	forward := &RecordingForwardDialer{OptionsDialer: NewOptionsDialer(testSocketOptions)}
+	dialer.forward = forward
+	dialer.Dial("pastagdsp33j7aoq.onion:443")
+	if forward.dialed != listener.Addr().String() {
+		t.Errorf("Forward dialer dialed %q", forward.dialed)
+	}
+}
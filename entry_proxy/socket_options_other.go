@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// control sets options which need setsockopt on the socket c.
+// Buffer sizes are set by apply on other systems.
+func (o SocketOptions) control(c syscall.RawConn, listener bool) error {
+	if o.UserTimeout != 0 || o.KeepAliveInterval != 0 || o.KeepAliveCount != 0 ||
+		(listener && o.FastOpen != 0) {
+		return errors.New("user_timeout, keepalive_interval, keepalive_count and fastopen are supported only on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadSocketConfig(t *testing.T) {
+	filename := writePolicyFile(t, `
+client:
+  keepalive_idle: 1m
+  keepalive_interval: 10s
+  keepalive_count: 3
+  nodelay: false
+  user_timeout: 30s
+  recv_buffer: 65536
+  fastopen: 128
+tor:
+  keepalive_idle: -1s
+  send_buffer: 131072
+`)
+	defer os.Remove(filename)
+	config, err := LoadSocketConfig(filename)
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	client := config.Client
+	if client.KeepAliveIdle != time.Minute || client.KeepAliveInterval != 10*time.Second ||
+		client.KeepAliveCount != 3 || client.NoDelay == nil || *client.NoDelay ||
+		client.UserTimeout != 30*time.Second || client.RecvBuffer != 65536 || client.FastOpen != 128 {
+		t.Errorf("Got client options %+v", client)
+	}
+	if config.Tor.KeepAliveIdle >= 0 || config.Tor.SendBuffer != 131072 || config.Tor.NoDelay != nil {
+		t.Errorf("Got Tor options %+v", config.Tor)
+	}
+	filename = writePolicyFile(t, "client:\n  nodely: true\n")
+	defer os.Remove(filename)
+	if _, err := LoadSocketConfig(filename); err == nil {
+		t.Errorf("Expected error for unknown option")
+	}
+}
+
+func TestLoadSocketConfigBadValues(t *testing.T) {
+	for _, config := range []string{
+		"client:\n  user_timeout: -1s\n",
+		"tor:\n  user_timeout: 100us\n",
+		"client:\n  keepalive_interval: 500ms\n",
+		"tor:\n  keepalive_interval: -10s\n",
+		"client:\n  keepalive_count: -1\n",
+		"client:\n  recv_buffer: -4096\n",
+	} {
+		filename := writePolicyFile(t, config)
+		if _, err := LoadSocketConfig(filename); err == nil {
+			t.Errorf("Config %q was accepted", config)
+		}
+		os.Remove(filename)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"sync"
+)
+
+// unwrapClientConn strips wrappers put around the client connection
+// while reading ClientHello. It returns the bytes they buffered, which
+// must be sent first, and the underlying connection. When both ends
+// are *net.TCPConn, io.Copy uses splice(2) on Linux and the data
+// does not pass through userspace.
+func unwrapClientConn(conn net.Conn) ([]byte, net.Conn) {
+	var buffered []byte
+	for {
+		switch c := conn.(type) {
+		case *replayConn:
+			buffered = append(buffered, c.buffered...)
+			c.buffered = nil
+			conn = c.Conn
+		case *helloRecorder:
+			conn = c.Conn
+		default:
+			return buffered, conn
+		}
+	}
+}
+
+// canSplice returns if io.Copy from src to dst uses splice(2).
+func canSplice(dst, src net.Conn) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	_, srcTCP := src.(*net.TCPConn)
+	_, srcUnix := src.(*net.UnixConn)
+	_, dstTCP := dst.(*net.TCPConn)
+	_, dstUnix := dst.(*net.UnixConn)
+	return (srcTCP && (dstTCP || dstUnix)) || (srcUnix && dstTCP)
+}
+
+// pipe sends buffered bytes of the client to the server and copies
+// the rest of both streams until they end, using buffers of the pool.
+func pipe(clientConn, serverConn net.Conn, buffers *BufferPool) error {
+	buffered, clientConn := unwrapClientConn(clientConn)
+	if len(buffered) != 0 {
+		if _, err := serverConn.Write(buffered); err != nil {
+			serverConn.Close()
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyLoop := func(dst, src net.Conn) {
+		defer wg.Done()
+		defer dst.Close()
+		buffers.Copy(dst, src)
+	}
+	go copyLoop(clientConn, serverConn)
+	go copyLoop(serverConn, clientConn)
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatalf("Getrusage failed: %s", err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// benchmarkProxyThroughput sends b.N chunks from the client to
+// the backend through the proxy and reports CPU time of the process.
+func benchmarkProxyThroughput(b *testing.B, parser SNIParser) {
+	hello := syntheticClientHello("example.com", nil)
+	chunk := make([]byte, 128*1024)
+	expected := int64(len(hello) + b.N*len(chunk))
+	proxy, done := startProxyToBackend(b, parser, ioutil.Discard, expected, nil)
+	defer proxy.listener.Close()
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		b.Fatalf("Failed to connect to proxy: %s", err)
+	}
+	defer conn.Close()
+	conn.Write(hello)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	start := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(chunk); err != nil {
+			b.Fatalf("Failed to write: %s", err)
+		}
+	}
+	if err := <-done; err != nil {
+		b.Fatalf("Backend failed: %s", err)
+	}
+	used := cpuTime(b) - start
+	b.StopTimer()
+	b.ReportMetric(float64(used.Nanoseconds())/float64(b.N), "cpu-ns/op")
+}
+
+func BenchmarkProxySplice(b *testing.B) {
+	benchmarkProxyThroughput(b, RealSNIParser{})
+}
+
+func BenchmarkProxyUserspaceCopy(b *testing.B) {
+	benchmarkProxyThroughput(b, OpaqueSNIParser{})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUnwrapClientConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	wrapped := &replayConn{
+		Conn:     &helloRecorder{Conn: server},
+		buffered: []byte("hello"),
+	}
+	buffered, raw := unwrapClientConn(wrapped)
+	if string(buffered) != "hello" || raw != server {
+		t.Errorf("Got %q and %v", buffered, raw)
+	}
+	if len(wrapped.buffered) != 0 {
+		t.Errorf("Buffered bytes were not taken")
+	}
+	opaque := struct{ net.Conn }{server}
+	if buffered, raw := unwrapClientConn(opaque); buffered != nil || raw != opaque {
+		t.Errorf("Unknown wrapper was unwrapped")
+	}
+}
+
+// OpaqueSNIParser hides *net.TCPConn behind a wrapper,
+// as SNI parsers did before, so data is copied in userspace.
+type OpaqueSNIParser struct{}
+
+func (p OpaqueSNIParser) ServerNameFromConn(clientConn net.Conn) (string, net.Conn, error) {
+	hostname, conn, err := RealSNIParser{}.ServerNameFromConn(clientConn)
+	return hostname, struct{ net.Conn }{conn}, err
+}
+
+// startProxyToBackend runs proxy forwarding to backend. The backend
+// copies expected number of bytes to sink, then sends reply and closes.
+// configure functions change the proxy before it starts.
+func startProxyToBackend(
+	t testing.TB,
+	parser SNIParser,
+	sink io.Writer,
+	expected int64,
+	reply []byte,
+	configure ...func(*TLSProxy),
+) (*TLSProxy, chan error) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer backend.Close()
+		conn, err := backend.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		if _, err := io.CopyN(sink, conn, expected); err != nil {
+			done <- err
+			return
+		}
+		_, err = conn.Write(reply)
+		done <- err
+	}()
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", MockOnionResolver("pastagdsp33j7aoq.onion"))
+	proxy.sniParser = parser
+	proxy.dialer = FixedDialer(backend.Addr().String())
+	for _, f := range configure {
+		f(proxy)
+	}
+	proxy.Listen("tcp", "127.0.0.1:0")
+	go proxy.Start()
+	return proxy, done
+}
+
+func TestProxyForwardsClientHello(t *testing.T) {
+	sent := append(syntheticClientHello("example.com", nil), bytes.Repeat([]byte("client data "), 10000)...)
+	reply := bytes.Repeat([]byte("server data "), 10000)
+	var received bytes.Buffer
+	proxy, done := startProxyToBackend(t, RealSNIParser{}, &received, int64(len(sent)), reply)
+	defer proxy.listener.Close()
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %s", err)
+	}
+	defer conn.Close()
+	go conn.Write(sent)
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Failed to read from proxy: %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Backend failed: %s", err)
+	}
+	if !bytes.Equal(data, reply) {
+		t.Errorf("Client got %d bytes, expected %d", len(data), len(reply))
+	}
+	if !bytes.Equal(received.Bytes(), sent) {
+		t.Errorf("Backend got %d bytes, expected %d", received.Len(), len(sent))
+	}
+}
+
+func withHandshakeTimeout(timeout time.Duration) func(*TLSProxy) {
+	return func(proxy *TLSProxy) {
+		proxy.handshakeTimeout = timeout
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	proxy, _ := startProxyToBackend(t, RealSNIParser{}, ioutil.Discard, 0, nil, withHandshakeTimeout(50*time.Millisecond))
+	defer proxy.listener.Close()
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); isTimeout(err) {
+		t.Fatalf("Proxy kept silent client connected")
+	}
+}
+
+func TestHandshakeTimeoutCleared(t *testing.T) {
+	hello := syntheticClientHello("example.com", nil)
+	rest := []byte("client data")
+	sent := append(append([]byte{}, hello...), rest...)
+	var received bytes.Buffer
+	proxy, done := startProxyToBackend(
+		t, RealSNIParser{}, &received, int64(len(sent)), []byte("reply"),
+		withHandshakeTimeout(50*time.Millisecond),
+	)
+	defer proxy.listener.Close()
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %s", err)
+	}
+	defer conn.Close()
+	conn.Write(hello)
+	// the stream must outlive the handshake timeout
+	time.Sleep(200 * time.Millisecond)
+	conn.Write(rest)
+	if err := <-done; err != nil {
+		t.Fatalf("Backend failed: %s", err)
+	}
+	if !bytes.Equal(received.Bytes(), sent) {
+		t.Errorf("Backend got %q, expected %q", received.Bytes(), sent)
+	}
+}
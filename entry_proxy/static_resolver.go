@@ -2,18 +2,222 @@ package main
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
+// StaticResolver resolves hosts using a map loaded from a file.
+//
+// Keys are hostnames. "*.example.com." matches every subdomain
+// of example.com (but not example.com itself); the most specific key
+// wins. Key "!host" excludes host (or "!*.example.com." excludes
+// subdomains) from a less specific wildcard.
+//
+// Values are either onion addresses or StaticEntry mappings.
+// See LoadStaticResolverPath for supported file formats.
 type StaticResolver struct {
-	Host2Onion map[string]string
+	Host2Onion map[string]StaticEntry
+
+	entries map[string]*staticEntry
+	now     func() time.Time
+}
+
+// StaticEntry holds options of a host in the static map.
+type StaticEntry struct {
+	// Onion is the onion address. Use Onions to list several
+	// onions, which are tried in the listed order.
+	Onion  string
+	Onions []string
+	// Port on the onion site; 0 means the default onion port.
+	Port int
+	// RateLimit is the maximum rate of new connections per second
+	// (0 means unlimited) and Burst is the number of connections
+	// allowed above it.
+	RateLimit float64
+	Burst     int
+	// Isolation puts connections to the host on separate Tor
+	// circuits from connections with other isolation tags.
+	Isolation string
+	// Enabled can be set to false to stop serving the host.
+	Enabled *bool
+}
+
+// UnmarshalYAML accepts both plain onion address and a mapping.
+func (e *StaticEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var onion string
+	if err := unmarshal(&onion); err == nil {
+		*e = StaticEntry{Onion: onion}
+		return nil
+	}
+	type plain StaticEntry
+	return unmarshal((*plain)(e))
+}
+
+func (e *StaticEntry) onions() []string {
+	if e.Onion != "" {
+		return append([]string{e.Onion}, e.Onions...)
+	}
+	return e.Onions
+}
+
+func (e *StaticEntry) validate() error {
+	for _, onion := range e.onions() {
+		if !onionRegexp.MatchString(onion) {
+			return fmt.Errorf("Bad onion address %q", onion)
+		}
+	}
+	if e.Port < 0 || e.Port > 65535 {
+		return fmt.Errorf("Bad port %d", e.Port)
+	}
+	if e.RateLimit < 0 {
+		return fmt.Errorf("Bad rate limit %g", e.RateLimit)
+	}
+	if e.Burst < 0 {
+		return fmt.Errorf("Bad burst %d", e.Burst)
+	}
+	if len(e.Isolation) > 255 {
+		return fmt.Errorf("Isolation tag is longer than 255 bytes")
+	}
+	return nil
+}
+
+type staticEntry struct {
+	options  StaticEntry
+	excluded bool
+
+	// token bucket of the rate limit
+	mutex   sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+// allow takes a token from the bucket if rate limit is set.
+func (e *staticEntry) allow(now time.Time) bool {
+	if e.options.RateLimit == 0 {
+		return true
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	capacity := float64(e.options.Burst) + 1
+	if e.updated.IsZero() {
+		e.tokens = capacity
+	} else {
+		e.tokens += now.Sub(e.updated).Seconds() * e.options.RateLimit
+		if e.tokens > capacity {
+			e.tokens = capacity
+		}
+	}
+	e.updated = now
+	if e.tokens < 1 {
+		return false
+	}
+	e.tokens--
+	return true
+}
+
+// LoadStaticResolver parses YAML host->onion map and checks it.
+func LoadStaticResolver(data []byte) (*StaticResolver, error) {
+	host2onion, err := parseStaticYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	r := &StaticResolver{Host2Onion: host2onion}
+	if err := r.prepare(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// normalizePattern brings key of the map to the form used in lookups:
+// fully qualified canonical hostname, optionally prefixed with "*.".
+func normalizePattern(pattern string) (string, error) {
+	prefix := ""
+	host := pattern
+	if strings.HasPrefix(pattern, "*.") {
+		prefix = "*."
+		host = pattern[len(prefix):]
+	}
+	host, err := NormalizeHostname(host)
+	if err != nil {
+		return "", fmt.Errorf("Bad host pattern %q: %s", pattern, err)
+	}
+	return prefix + dns.Fqdn(host), nil
+}
+
+// prepare builds lookup table from Host2Onion and detects conflicts.
+func (r *StaticResolver) prepare() error {
+	r.entries = make(map[string]*staticEntry)
+	r.now = time.Now
+	sources := make(map[string]string)
+	for key, options := range r.Host2Onion {
+		excluded := strings.HasPrefix(key, "!")
+		pattern, err := normalizePattern(strings.TrimPrefix(key, "!"))
+		if err != nil {
+			return err
+		}
+		if !excluded && len(options.onions()) == 0 {
+			return fmt.Errorf("No onion for key %q", key)
+		}
+		if err := options.validate(); err != nil {
+			return fmt.Errorf("Bad entry %q: %s", key, err)
+		}
+		if other, ok := sources[pattern]; ok {
+			return fmt.Errorf("Keys %q and %q conflict", other, key)
+		}
+		sources[pattern] = key
+		r.entries[pattern] = &staticEntry{options: options, excluded: excluded}
+	}
+	return nil
+}
+
+// lookup finds the most specific entry matching host.
+func (r *StaticResolver) lookup(host string) *staticEntry {
+	if entry, ok := r.entries[host]; ok {
+		return entry
+	}
+	labels := strings.SplitAfter(host, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		pattern := "*." + strings.Join(labels[i:], "")
+		if entry, ok := r.entries[pattern]; ok {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (r *StaticResolver) ResolveToTargets(host string) ([]OnionTarget, error) {
+	entry := r.lookup(dns.Fqdn(strings.ToLower(host)))
+	if entry == nil {
+		return nil, newResolveError(NotFound, "No key %q in host->onion map", host)
+	}
+	if entry.excluded {
+		return nil, newResolveError(PolicyDenied, "Host %q is excluded in host->onion map", host)
+	}
+	if entry.options.Enabled != nil && !*entry.options.Enabled {
+		return nil, newResolveError(PolicyDenied, "Host %q is disabled in host->onion map", host)
+	}
+	if !entry.allow(r.now()) {
+		return nil, newResolveError(PolicyDenied, "Rate limit of host %q exceeded", host)
+	}
+	var targets []OnionTarget
+	for i, onion := range entry.options.onions() {
+		targets = append(targets, OnionTarget{
+			Onion:     onion,
+			Port:      entry.options.Port,
+			Priority:  i,
+			Isolation: entry.options.Isolation,
+		})
+	}
+	return targets, nil
 }
 
 func (r *StaticResolver) ResolveToOnion(host string) (string, error) {
-	onion, ok := r.Host2Onion[dns.Fqdn(host)]
-	if !ok {
-		return "", fmt.Errorf("No key %q in host->onion map", host)
+	targets, err := r.ResolveToTargets(host)
+	if err != nil {
+		return "", err
 	}
-	return onion, nil
+	return targets[0].Onion, nil
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const wildcardHost2Onion = `
+host2onion:
+    www.pasta.cf.: pastagdsp33j7aoq.onion
+    "*.pasta.cf.": t3mny6lhnyku4wrd.onion
+    "*.static.pasta.cf": abcdef1234567654.onion
+    "!private.pasta.cf.": ""
+    "!*.secret.pasta.cf.": ""
+`
+
+func TestStaticResolverWildcards(t *testing.T) {
+	resolver, err := LoadStaticResolver([]byte(wildcardHost2Onion))
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	for host, want := range map[string]string{
+		"www.pasta.cf":          "pastagdsp33j7aoq.onion",
+		"WWW.Pasta.CF.":         "pastagdsp33j7aoq.onion",
+		"api.pasta.cf":          "t3mny6lhnyku4wrd.onion",
+		"a.b.pasta.cf":          "t3mny6lhnyku4wrd.onion",
+		"img.static.pasta.cf":   "abcdef1234567654.onion",
+		"secret.pasta.cf":       "t3mny6lhnyku4wrd.onion",
+		"x.www.pasta.cf.":       "t3mny6lhnyku4wrd.onion",
+		"static.pasta.cf":       "t3mny6lhnyku4wrd.onion",
+		"a.img.static.pasta.cf": "abcdef1234567654.onion",
+	} {
+		onion, err := resolver.ResolveToOnion(host)
+		if err != nil {
+			t.Errorf("Failed to resolve %s: %s", host, err)
+		} else if onion != want {
+			t.Errorf("Resolved %s to %s, expected %s", host, onion, want)
+		}
+	}
+	for _, host := range []string{
+		"pasta.cf",
+		"private.pasta.cf",
+		"x.secret.pasta.cf",
+		"example.com",
+	} {
+		if onion, err := resolver.ResolveToOnion(host); err == nil {
+			t.Errorf("Resolved %s to %s, expected error", host, onion)
+		}
+	}
+}
+
+func TestStaticResolverConflicts(t *testing.T) {
+	for _, config := range []string{
+		"host2onion: {pasta.cf.: pastagdsp33j7aoq.onion, PASTA.cf: t3mny6lhnyku4wrd.onion}",
+		"host2onion: {pasta.cf.: pastagdsp33j7aoq.onion, \"!pasta.cf.\": \"\"}",
+		"host2onion: {\"*.pasta.cf\": pastagdsp33j7aoq.onion, \"!*.pasta.cf.\": \"\"}",
+		"host2onion: {\"www.*.pasta.cf\": pastagdsp33j7aoq.onion}",
+		"host2onion: {\"*\": pastagdsp33j7aoq.onion}",
+		"host2onion: {pasta.cf: \"\"}",
+	} {
+		if _, err := LoadStaticResolver([]byte(config)); err == nil {
+			t.Errorf("Config %q was accepted", config)
+		}
+	}
+}
+
+const optionsHost2Onion = `
+host2onion:
+    www.pasta.cf.: pastagdsp33j7aoq.onion
+    api.pasta.cf.:
+        onions: [t3mny6lhnyku4wrd.onion, pastagdsp33j7aoq.onion]
+        port: 8443
+        isolation: api
+    slow.pasta.cf.:
+        onion: pastagdsp33j7aoq.onion
+        ratelimit: 1
+        burst: 1
+    old.pasta.cf.:
+        onion: pastagdsp33j7aoq.onion
+        enabled: false
+`
+
+func TestStaticResolverOptions(t *testing.T) {
+	resolver, err := LoadStaticResolver([]byte(optionsHost2Onion))
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	targets, err := resolver.ResolveToTargets("api.pasta.cf")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	want := []OnionTarget{
+		{Onion: "t3mny6lhnyku4wrd.onion", Port: 8443, Priority: 0, Isolation: "api"},
+		{Onion: "pastagdsp33j7aoq.onion", Port: 8443, Priority: 1, Isolation: "api"},
+	}
+	if len(targets) != len(want) || targets[0] != want[0] || targets[1] != want[1] {
+		t.Fatalf("Got %v, expected %v", targets, want)
+	}
+	targets, err = resolver.ResolveToTargets("www.pasta.cf")
+	if err != nil || len(targets) != 1 || targets[0] != (OnionTarget{Onion: "pastagdsp33j7aoq.onion"}) {
+		t.Fatalf("Plain entry resolved to %v, %v", targets, err)
+	}
+	if _, err := resolver.ResolveToOnion("old.pasta.cf"); err == nil {
+		t.Fatalf("Disabled host was resolved")
+	}
+}
+
+func TestStaticResolverRateLimit(t *testing.T) {
+	resolver, err := LoadStaticResolver([]byte(optionsHost2Onion))
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	now := time.Unix(1500000000, 0)
+	resolver.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.ResolveToOnion("slow.pasta.cf"); err != nil {
+			t.Fatalf("Connection %d within burst was limited: %s", i, err)
+		}
+	}
+	if _, err := resolver.ResolveToOnion("slow.pasta.cf"); err == nil {
+		t.Fatalf("Connection over the burst was allowed")
+	}
+	now = now.Add(time.Second)
+	if _, err := resolver.ResolveToOnion("slow.pasta.cf"); err != nil {
+		t.Fatalf("Connection after a second was limited: %s", err)
+	}
+}
+
+func TestStaticResolverBadOptions(t *testing.T) {
+	for _, config := range []string{
+		"host2onion: {pasta.cf: notanonion}",
+		"host2onion: {pasta.cf: {onions: []}}",
+		"host2onion: {pasta.cf: {onion: pastagdsp33j7aoq.onion, port: 70000}}",
+		"host2onion: {pasta.cf: {onion: pastagdsp33j7aoq.onion, ratelimit: -1}}",
+		"host2onion: {pasta.cf: {onion: pastagdsp33j7aoq.onion, burst: -1}}",
+		"host2onion: {pasta.cf: {onion: pastagdsp33j7aoq.onion, enabled: maybe}}",
+	} {
+		if _, err := LoadStaticResolver([]byte(config)); err == nil {
+			t.Errorf("Config %q was accepted", config)
+		}
+	}
+}
+
+func TestStaticResolverUnknownKeys(t *testing.T) {
+	config := "host2onion: {pasta.cf: {onion: pastagdsp33j7aoq.onion, colour: red}}\nversion: 2\n"
+	resolver, err := LoadStaticResolver([]byte(config))
+	if err != nil {
+		t.Fatalf("Config with unknown keys was rejected: %s", err)
+	}
+	if onion, err := resolver.ResolveToOnion("pasta.cf"); err != nil || onion != "pastagdsp33j7aoq.onion" {
+		t.Fatalf("Resolved to %q, %v", onion, err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// UnmarshalJSON accepts both plain onion address and an object.
+func (e *StaticEntry) UnmarshalJSON(data []byte) error {
+	var onion string
+	if err := json.Unmarshal(data, &onion); err == nil {
+		*e = StaticEntry{Onion: onion}
+		return nil
+	}
+	type plain StaticEntry
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode((*plain)(e))
+}
+
+// parseStaticYAML ignores unknown keys, as older versions did, but logs
+// them so that typos in options are noticed.
+func parseStaticYAML(data []byte) (map[string]StaticEntry, error) {
+	var r StaticResolver
+	if err := yaml.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(data, &StaticResolver{}); err != nil {
+		log.Printf("Ignoring unknown keys of host->onion map: %s", err)
+	}
+	return r.Host2Onion, nil
+}
+
+func parseStaticJSON(data []byte) (map[string]StaticEntry, error) {
+	var r StaticResolver
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&r); err != nil {
+		return nil, err
+	}
+	return r.Host2Onion, nil
+}
+
+// parseStaticCSV parses CSV with header. Column "host" is required,
+// other columns are named after fields of StaticEntry. Column "onion"
+// may list several onions separated by spaces.
+func parseStaticCSV(data []byte) (map[string]StaticEntry, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CSV header: %s", err)
+	}
+	hostColumn := -1
+	for i, name := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(name))
+		switch header[i] {
+		case "host":
+			hostColumn = i
+		case "onion", "port", "ratelimit", "burst", "isolation", "enabled":
+		default:
+			return nil, fmt.Errorf("Unknown CSV column %q", name)
+		}
+	}
+	if hostColumn == -1 {
+		return nil, fmt.Errorf("No host column in CSV header")
+	}
+	host2onion := make(map[string]StaticEntry)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry StaticEntry
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			switch header[i] {
+			case "onion":
+				entry.Onions = strings.Fields(value)
+			case "port":
+				entry.Port, err = strconv.Atoi(value)
+			case "ratelimit":
+				entry.RateLimit, err = strconv.ParseFloat(value, 64)
+			case "burst":
+				entry.Burst, err = strconv.Atoi(value)
+			case "isolation":
+				entry.Isolation = value
+			case "enabled":
+				var enabled bool
+				enabled, err = strconv.ParseBool(value)
+				entry.Enabled = &enabled
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Bad %s of %q: %s", header[i], record[hostColumn], err)
+			}
+		}
+		host := record[hostColumn]
+		if _, ok := host2onion[host]; ok {
+			return nil, fmt.Errorf("Host %q is listed twice", host)
+		}
+		host2onion[host] = entry
+	}
+	return host2onion, nil
+}
+
+// staticParsers maps file extensions to parsers of host->onion map.
+var staticParsers = map[string]func([]byte) (map[string]StaticEntry, error){
+	".yaml": parseStaticYAML,
+	".yml":  parseStaticYAML,
+	".json": parseStaticJSON,
+	".csv":  parseStaticCSV,
+}
+
+// parseStaticFile parses host->onion map choosing format by extension.
+func parseStaticFile(filename string) (map[string]StaticEntry, error) {
+	parse, ok := staticParsers[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return nil, fmt.Errorf("Unknown format of %s", filename)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	host2onion, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", filename, err)
+	}
+	return host2onion, nil
+}
+
+// LoadStaticResolverPath loads host->onion map from a YAML, JSON or CSV
+// file, or from a directory of such files. Hidden files and files with
+// other extensions in the directory are skipped.
+// A key defined in several files is an error.
+func LoadStaticResolverPath(path string) (*StaticResolver, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	filenames := []string{path}
+	if info.IsDir() {
+		filenames = nil
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			if _, ok := staticParsers[strings.ToLower(filepath.Ext(file.Name()))]; !ok {
+				log.Printf("Skipping %s: unknown format of host->onion map", filepath.Join(path, file.Name()))
+				continue
+			}
+			filenames = append(filenames, filepath.Join(path, file.Name()))
+		}
+		sort.Strings(filenames)
+	}
+	r := &StaticResolver{Host2Onion: make(map[string]StaticEntry)}
+	sources := make(map[string]string)
+	for _, filename := range filenames {
+		host2onion, err := parseStaticFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		for key, entry := range host2onion {
+			if other, ok := sources[key]; ok {
+				return nil, fmt.Errorf("Key %q is defined in %s and %s", key, other, filename)
+			}
+			sources[key] = filename
+			r.Host2Onion[key] = entry
+		}
+	}
+	if err := r.prepare(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
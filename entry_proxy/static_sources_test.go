@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func makeStaticDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "host2onion")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+func TestLoadStaticResolverDirectory(t *testing.T) {
+	dir := makeStaticDir(t, map[string]string{
+		"pasta.yaml": "host2onion: {www.pasta.cf.: pastagdsp33j7aoq.onion}\n",
+		"boom.json":  `{"host2onion": {"boom-fold.tk.": {"onion": "t3mny6lhnyku4wrd.onion", "port": 8443}}}`,
+		"more.csv": "host,onion,port,enabled\n" +
+			"# comment\n" +
+			"a.example.com,abcdef1234567654.onion pastagdsp33j7aoq.onion,,\n" +
+			"b.example.com,abcdef1234567654.onion,8080,false\n",
+		".hidden.txt": "ignored",
+		"README":      "Host->onion maps of the gateway",
+		"pasta.yaml~": "host2onion: {www.pasta.cf.: t3mny6lhnyku4wrd.onion}\n",
+	})
+	defer os.RemoveAll(dir)
+	resolver, err := LoadStaticResolverPath(dir)
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	for host, want := range map[string]OnionTarget{
+		"www.pasta.cf":  {Onion: "pastagdsp33j7aoq.onion"},
+		"boom-fold.tk":  {Onion: "t3mny6lhnyku4wrd.onion", Port: 8443},
+		"a.example.com": {Onion: "abcdef1234567654.onion"},
+	} {
+		targets, err := resolver.ResolveToTargets(host)
+		if err != nil {
+			t.Errorf("Failed to resolve %s: %s", host, err)
+		} else if targets[0] != want {
+			t.Errorf("Resolved %s to %v, expected %v", host, targets[0], want)
+		}
+	}
+	targets, _ := resolver.ResolveToTargets("a.example.com")
+	if len(targets) != 2 {
+		t.Errorf("Expected two onions from CSV, got %v", targets)
+	}
+	if _, err := resolver.ResolveToOnion("b.example.com"); err == nil {
+		t.Errorf("Disabled host from CSV was resolved")
+	}
+}
+
+func TestLoadStaticResolverSingleFile(t *testing.T) {
+	resolver, err := LoadStaticResolverPath("host2onion.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err)
+	}
+	if _, err := resolver.ResolveToOnion("www.pasta.cf"); err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+}
+
+func TestLoadStaticResolverUnknownFormat(t *testing.T) {
+	dir := makeStaticDir(t, map[string]string{
+		"a.txt": "pasta.cf pastagdsp33j7aoq.onion",
+	})
+	defer os.RemoveAll(dir)
+	if _, err := LoadStaticResolverPath(filepath.Join(dir, "a.txt")); err == nil {
+		t.Errorf("File of unknown format was accepted")
+	}
+}
+
+func TestLoadStaticResolverErrors(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"duplicate": {
+			"a.yaml": "host2onion: {pasta.cf.: pastagdsp33j7aoq.onion}",
+			"b.json": `{"host2onion": {"pasta.cf.": "t3mny6lhnyku4wrd.onion"}}`,
+		},
+		"normalized duplicate": {
+			"a.yaml": "host2onion: {pasta.cf.: pastagdsp33j7aoq.onion}",
+			"b.csv":  "host,onion\nPasta.cf,t3mny6lhnyku4wrd.onion\n",
+		},
+		"unknown json field": {
+			"a.json": `{"host2onion": {"pasta.cf.": {"onion": "pastagdsp33j7aoq.onion", "colour": "red"}}}`,
+		},
+		"unknown csv column": {
+			"a.csv": "host,onion,colour\npasta.cf,pastagdsp33j7aoq.onion,red\n",
+		},
+		"bad csv port": {
+			"a.csv": "host,onion,port\npasta.cf,pastagdsp33j7aoq.onion,http\n",
+		},
+		"csv without host": {
+			"a.csv": "onion\npastagdsp33j7aoq.onion\n",
+		},
+	} {
+		dir := makeStaticDir(t, files)
+		if _, err := LoadStaticResolverPath(dir); err == nil {
+			t.Errorf("Case %q was accepted", name)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -1,36 +1,69 @@
 package main
 
 import (
-    "fmt"
-    "strings"
-    "regexp"
+	"regexp"
+	"strings"
 )
 
+// SubdomainResolver reads onion address from a label of the hostname
+// under one of parent domains, e.g. <onion>.gateway.com.
 type SubdomainResolver struct {
-    regex       *regexp.Regexp
-    parentDomain string
-}
+	regex         *regexp.Regexp
+	parentDomains []string
 
-func NewSubdomainResolver(parent_domain string) *SubdomainResolver {
-    return &SubdomainResolver{
-        parentDomain: parent_domain,
-        regex:        regexp.MustCompile("^([a-z0-9]{16})$"),
-    }
+	// anyDepth accepts the onion label anywhere in the subdomain,
+	// not only directly under the parent domain.
+	anyDepth bool
 }
 
-func (r *SubdomainResolver) ResolveToOnion(host string) (string, error) {
+// normalizeDomain returns canonical form of domain (see NormalizeHostname),
+// falling back to lowercase without trailing dot for invalid names.
+func normalizeDomain(domain string) string {
+	if normalized, err := NormalizeHostname(domain); err == nil {
+		return normalized
+	}
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
 
-    if !strings.HasSuffix(host, r.parentDomain) {
-        return "", fmt.Errorf("Host %q is not a subdomain of %q", host, r.parentDomain)
-    }
+func NewSubdomainResolver(parentDomains ...string) *SubdomainResolver {
+	r := &SubdomainResolver{
+		regex: regexp.MustCompile("^([a-z0-9]{16}|[a-z2-7]{56})$"),
+	}
+	for _, parent := range parentDomains {
+		r.parentDomains = append(r.parentDomains, normalizeDomain(parent))
+	}
+	return r
+}
 
-    subdomains := strings.TrimSuffix(host, "." + r.parentDomain)
-    subdomain_parts := strings.Split(subdomains, ".")
-    onion := subdomain_parts[len(subdomain_parts)-1]
+// subdomainLabels returns labels of host under the most specific
+// parent domain, or nil if host is not a subdomain of any of them.
+func (r *SubdomainResolver) subdomainLabels(host string) []string {
+	var labels []string
+	longestParent := -1
+	for _, parent := range r.parentDomains {
+		if len(parent) <= longestParent || !strings.HasSuffix(host, "."+parent) {
+			continue
+		}
+		longestParent = len(parent)
+		labels = strings.Split(strings.TrimSuffix(host, "."+parent), ".")
+	}
+	return labels
+}
 
-    match := r.regex.FindStringSubmatch(onion)
-    if match != nil {
-        return match[1] + ".onion", nil // the match we are interested in
-    }
-    return "", fmt.Errorf("The hostname %q did not have a valid onion address subdomain", host)
+func (r *SubdomainResolver) ResolveToOnion(host string) (string, error) {
+	host = normalizeDomain(host)
+	labels := r.subdomainLabels(host)
+	if labels == nil {
+		return "", newResolveError(NotFound, "Host %q is not a subdomain of %q", host, r.parentDomains)
+	}
+	// search from the label closest to the parent domain
+	for i := len(labels) - 1; i >= 0; i-- {
+		if r.regex.MatchString(labels[i]) {
+			return labels[i] + ".onion", nil
+		}
+		if !r.anyDepth {
+			break
+		}
+	}
+	return "", newResolveError(NotFound, "The hostname %q did not have a valid onion address subdomain", host)
 }
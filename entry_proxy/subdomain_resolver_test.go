@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+const v3Label = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+
+func TestSubdomainResolver(t *testing.T) {
+	resolver := NewSubdomainResolver("example.com", "GW.example.org.")
+	for host, want := range map[string]string{
+		"pastagdsp33j7aoq.example.com":     "pastagdsp33j7aoq.onion",
+		"PASTAGDSP33J7AOQ.Example.COM.":    "pastagdsp33j7aoq.onion",
+		"www.pastagdsp33j7aoq.example.com": "pastagdsp33j7aoq.onion",
+		"pastagdsp33j7aoq.gw.example.org":  "pastagdsp33j7aoq.onion",
+		v3Label + ".example.com":           v3Label + ".onion",
+	} {
+		onion, err := resolver.ResolveToOnion(host)
+		if err != nil {
+			t.Errorf("Failed to resolve %s: %s", host, err)
+		} else if onion != want {
+			t.Errorf("Resolved %s to %s, expected %s", host, onion, want)
+		}
+	}
+	for _, host := range []string{
+		"example.com",
+		"pastagdsp33j7aoq.evilexample.com",
+		"pastagdsp33j7aoqexample.com",
+		"pastagdsp33j7aoq.example.org",
+		"pastagdsp33j7aoq.example.com.evil.net",
+		"www.example.com",
+		"pastagdsp33j7aoq.www.example.com",
+	} {
+		if onion, err := resolver.ResolveToOnion(host); err == nil {
+			t.Errorf("Resolved %s to %s, expected error", host, onion)
+		}
+	}
+}
+
+func TestSubdomainResolverAnyDepth(t *testing.T) {
+	resolver := NewSubdomainResolver("example.com")
+	resolver.anyDepth = true
+	for _, host := range []string{
+		"www.pastagdsp33j7aoq.example.com",
+		"pastagdsp33j7aoq.www.example.com",
+	} {
+		if onion, err := resolver.ResolveToOnion(host); err != nil || onion != "pastagdsp33j7aoq.onion" {
+			t.Errorf("Resolved %s to %q, %v", host, onion, err)
+		}
+	}
+}
+
+func TestSubdomainResolverMostSpecificParent(t *testing.T) {
+	resolver := NewSubdomainResolver("example.com", "pastagdsp33j7aoq.example.com")
+	onion, err := resolver.ResolveToOnion("t3mny6lhnyku4wrd.pastagdsp33j7aoq.example.com")
+	if err != nil || onion != "t3mny6lhnyku4wrd.onion" {
+		t.Errorf("Resolved to %q, %v", onion, err)
+	}
+}
+
+func TestSubdomainResolverIDNParent(t *testing.T) {
+	resolver := NewSubdomainResolver("bücher.example")
+	onion, err := resolver.ResolveToOnion("pastagdsp33j7aoq.xn--bcher-kva.example")
+	if err != nil || onion != "pastagdsp33j7aoq.onion" {
+		t.Errorf("Resolved to %q, %v", onion, err)
+	}
+}
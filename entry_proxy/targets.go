@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// OnionTarget is one onion service candidate for a host.
+// Port 0 means the proxy's default onion port.
+// Verified is set if the onion service has signed the binding.
+// Connections with different Isolation tags use different circuits.
+type OnionTarget struct {
+	Onion     string
+	Port      int
+	Priority  int
+	Weight    int
+	Verified  bool
+	Isolation string
+}
+
+// HostToTargetsResolver is implemented by resolvers which can return
+// several candidates with ports and ordering information.
+type HostToTargetsResolver interface {
+	ResolveToTargets(hostname string) ([]OnionTarget, error)
+}
+
+// ResolveTargets returns onion candidates for hostname, ordered by
+// preference. Resolvers which only implement HostToOnionResolver
+// produce a single candidate on the default port.
+func ResolveTargets(
+	resolver HostToOnionResolver,
+	hostname string,
+) ([]OnionTarget, error) {
+	if targetsResolver, ok := resolver.(HostToTargetsResolver); ok {
+		return targetsResolver.ResolveToTargets(hostname)
+	}
+	onion, err := resolver.ResolveToOnion(hostname)
+	if err != nil {
+		return nil, err
+	}
+	return []OnionTarget{{Onion: onion}}, nil
+}
+
+type byPriority []OnionTarget
+
+func (p byPriority) Len() int           { return len(p) }
+func (p byPriority) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPriority) Less(i, j int) bool { return p[i].Priority < p[j].Priority }
+
+// OrderTargets sorts targets by ascending priority and shuffles targets
+// of equal priority according to their weights, as described in RFC 2782.
+func OrderTargets(targets []OnionTarget, randIntn func(n int) int) {
+	if randIntn == nil {
+		randIntn = rand.Intn
+	}
+	sort.Stable(byPriority(targets))
+	for start := 0; start < len(targets); {
+		end := start + 1
+		for end < len(targets) && targets[end].Priority == targets[start].Priority {
+			end++
+		}
+		weightedShuffle(targets[start:end], randIntn)
+		start = end
+	}
+}
+
+// weightedShuffle orders targets by the selection of RFC 2782: targets
+// of weight 0 are put first, then a random number between 0 and the sum
+// of weights is chosen and the first target whose running sum of weights
+// reaches it is selected. Targets of weight 0 are thus rarely selected
+// while targets of non-zero weight remain.
+func weightedShuffle(targets []OnionTarget, randIntn func(n int) int) {
+	for i := range targets {
+		remaining := targets[i:]
+		sort.SliceStable(remaining, func(a, b int) bool {
+			return remaining[a].Weight == 0 && remaining[b].Weight != 0
+		})
+		total := 0
+		for _, target := range remaining {
+			total += target.Weight
+		}
+		pick := randIntn(total + 1)
+		sum := 0
+		for j := range remaining {
+			sum += remaining[j].Weight
+			if sum >= pick {
+				remaining[0], remaining[j] = remaining[j], remaining[0]
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOrderTargetsByPriority(t *testing.T) {
+	targets := []OnionTarget{
+		{Onion: "c.onion", Priority: 30},
+		{Onion: "a.onion", Priority: 10},
+		{Onion: "b.onion", Priority: 20},
+	}
+	OrderTargets(targets, nil)
+	for i, onion := range []string{"a.onion", "b.onion", "c.onion"} {
+		if targets[i].Onion != onion {
+			t.Fatalf("Got %v, expected %s at position %d", targets, onion, i)
+		}
+	}
+}
+
+func TestOrderTargetsByWeight(t *testing.T) {
+	targets := []OnionTarget{
+		{Onion: "heavy.onion", Weight: 9},
+		{Onion: "light.onion", Weight: 0},
+	}
+	// Any number from 1 to the sum of weights selects heavy.onion.
+	OrderTargets(targets, func(n int) int { return n - 1 })
+	if targets[0].Onion != "heavy.onion" {
+		t.Fatalf("Expected heavy.onion first, got %v", targets)
+	}
+	OrderTargets(targets, func(n int) int { return 1 })
+	if targets[0].Onion != "heavy.onion" {
+		t.Fatalf("Expected heavy.onion first, got %v", targets)
+	}
+	// Only 0 selects the target of weight 0, which is put first.
+	OrderTargets(targets, func(n int) int { return 0 })
+	if targets[0].Onion != "light.onion" {
+		t.Fatalf("Expected light.onion first, got %v", targets)
+	}
+}
+
+func TestOrderTargetsZeroWeights(t *testing.T) {
+	targets := []OnionTarget{
+		{Onion: "a.onion"},
+		{Onion: "b.onion"},
+	}
+	OrderTargets(targets, func(n int) int { return n - 1 })
+	if targets[0].Onion != "a.onion" || targets[1].Onion != "b.onion" {
+		t.Fatalf("Expected order to be kept, got %v", targets)
+	}
+}
+
+type MockOnionResolver string
+
+func (m MockOnionResolver) ResolveToOnion(hostname string) (string, error) {
+	return string(m), nil
+}
+
+func TestResolveTargetsPlainResolver(t *testing.T) {
+	targets, err := ResolveTargets(MockOnionResolver("a.onion"), "example.com")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	if len(targets) != 1 || targets[0] != (OnionTarget{Onion: "a.onion"}) {
+		t.Fatalf("Unexpected targets %v", targets)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+)
+
+// TLS alert descriptions, RFC 5246 section 7.2.
+const (
+	alertHandshakeFailure byte = 40
+	alertAccessDenied     byte = 49
+	alertInternalError    byte = 80
+	alertUnrecognizedName byte = 112
+)
+
+const (
+	recordTypeHandshake byte = 22
+	recordTypeAlert     byte = 21
+	alertLevelFatal     byte = 2
+	recordHeaderLength       = 5
+)
+
+// defaultRecordVersion is TLS 1.0, accepted by all clients.
+var defaultRecordVersion = [2]byte{3, 1}
+
+// helloRecorder remembers the header of the first TLS record
+// read from the client, so alerts can use the same record version.
+type helloRecorder struct {
+	net.Conn
+	header []byte
+}
+
+func (r *helloRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if missing := recordHeaderLength - len(r.header); missing > 0 {
+		if missing > n {
+			missing = n
+		}
+		r.header = append(r.header, b[:missing]...)
+	}
+	return n, err
+}
+
+// recordVersion returns record version of the ClientHello,
+// or TLS 1.0 if the client did not send a TLS handshake record.
+func (r *helloRecorder) recordVersion() [2]byte {
+	if len(r.header) < 3 || r.header[0] != recordTypeHandshake || r.header[1] != 3 {
+		return defaultRecordVersion
+	}
+	return [2]byte{r.header[1], r.header[2]}
+}
+
+// sendTLSAlert writes fatal TLS alert record to the client.
+func sendTLSAlert(conn net.Conn, version [2]byte, description byte) error {
+	record := []byte{
+		recordTypeAlert,
+		version[0], version[1],
+		0, 2, // length
+		alertLevelFatal,
+		description,
+	}
+	_, err := conn.Write(record)
+	return err
+}
+
+// resolveErrorAlert chooses alert sent to the client when
+// the host can not be resolved.
+func resolveErrorAlert(kind ResolveErrorKind) byte {
+	switch kind {
+	case NotFound, InvalidRecord:
+		return alertUnrecognizedName
+	case PolicyDenied:
+		return alertAccessDenied
+	}
+	return alertInternalError
+}
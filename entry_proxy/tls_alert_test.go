@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// RecordSNIParser consumes the first TLS record like a real parser,
+// but always returns the same server name.
+type RecordSNIParser struct {
+	hostname string
+}
+
+func (p RecordSNIParser) ServerNameFromConn(clientConn net.Conn) (string, net.Conn, error) {
+	header := make([]byte, recordHeaderLength)
+	if _, err := io.ReadFull(clientConn, header); err != nil {
+		return "", nil, err
+	}
+	length := int(header[3])<<8 | int(header[4])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(clientConn, body); err != nil {
+		return "", nil, err
+	}
+	hello := append(header, body...)
+	return p.hostname, &replayConn{Conn: clientConn, buffered: hello}, nil
+}
+
+type ErrorResolver struct {
+	err error
+}
+
+func (r ErrorResolver) ResolveToOnion(hostname string) (string, error) {
+	return "", r.err
+}
+
+type FailingDialer struct{}
+
+func (d FailingDialer) Dial(targetServer string) (net.Conn, error) {
+	return nil, errors.New("Tor is down")
+}
+
+func startFailingProxy(resolver HostToOnionResolver, hostname string) *TLSProxy {
+	proxy := NewTLSProxy(443, "tcp", "127.0.0.1:1", resolver)
+	proxy.sniParser = RecordSNIParser{hostname: hostname}
+	proxy.dialer = FailingDialer{}
+	proxy.Listen("tcp", "127.0.0.1:0")
+	go proxy.Start()
+	return proxy
+}
+
+func dialThroughProxy(t *testing.T, resolver HostToOnionResolver) error {
+	proxy := startFailingProxy(resolver, "example.com")
+	defer proxy.listener.Close()
+	conn, err := tls.Dial("tcp", proxy.Addr().String(), &tls.Config{
+		ServerName: "example.com",
+	})
+	if err == nil {
+		conn.Close()
+		t.Fatalf("TLS handshake succeeded")
+	}
+	return err
+}
+
+func TestTLSAlertsForRealClient(t *testing.T) {
+	for want, resolver := range map[string]HostToOnionResolver{
+		"unrecognized name": ErrorResolver{newResolveError(NotFound, "no such host")},
+		"access denied":     ErrorResolver{newResolveError(PolicyDenied, "blocked")},
+		"internal error":    MockOnionResolver("pastagdsp33j7aoq.onion"),
+	} {
+		err := dialThroughProxy(t, resolver)
+		if !strings.Contains(err.Error(), "remote error") || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected alert %q, got error %q", want, err)
+		}
+	}
+}
+
+func TestHelloRecorderVersion(t *testing.T) {
+	for _, c := range []struct {
+		data []byte
+		want [2]byte
+	}{
+		{[]byte{22, 3, 3, 0, 10, 1, 2}, [2]byte{3, 3}},
+		{[]byte{22, 3, 1, 0, 10}, [2]byte{3, 1}},
+		{[]byte{22, 3}, defaultRecordVersion},
+		{[]byte("GET / HTTP/1.1\r\n"), defaultRecordVersion},
+		{nil, defaultRecordVersion},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(c.data)
+			client.Close()
+		}()
+		recorder := &helloRecorder{Conn: server}
+		buffer := make([]byte, 2)
+		for {
+			// small reads must still collect the whole header
+			if _, err := recorder.Read(buffer); err != nil {
+				break
+			}
+		}
+		if got := recorder.recordVersion(); got != c.want {
+			t.Errorf("Data %v: got version %v, expected %v", c.data, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// TOFUPolicy defines what TOFUResolver does when a host
+// resolves to an onion which was not seen for it before.
+type TOFUPolicy int
+
+const (
+	// TOFUWarn logs the change and replaces the pin with the onions
+	// the host resolves to now, so the old onion is no longer trusted.
+	TOFUWarn TOFUPolicy = iota
+	// TOFUBlock logs the change and refuses the new onion
+	// until the change is approved.
+	TOFUBlock
+)
+
+func ParseTOFUPolicy(name string) (TOFUPolicy, error) {
+	switch name {
+	case "warn":
+		return TOFUWarn, nil
+	case "block":
+		return TOFUBlock, nil
+	}
+	return TOFUWarn, fmt.Errorf("Unknown TOFU policy %q", name)
+}
+
+// TOFUPin is the set of onions trusted for a host.
+type TOFUPin struct {
+	Onions    []string
+	FirstSeen time.Time
+	Pending   []string `yaml:",omitempty"`
+}
+
+// maxTOFUHistory limits the number of events kept in the store;
+// the oldest ones are dropped.
+const maxTOFUHistory = 1000
+
+// TOFUEvent is a record of audit history.
+type TOFUEvent struct {
+	Time   time.Time
+	Host   string
+	Onion  string
+	Action string
+}
+
+// TOFUStore is the content of the file of TOFUResolver.
+type TOFUStore struct {
+	Pins    map[string]*TOFUPin
+	History []TOFUEvent
+}
+
+// TOFUResolver is a decorator which remembers onions first seen for
+// each host and detects when the host starts resolving to another onion.
+// The file may be changed by another process (-tofu-approve); it is
+// reloaded before each check if it was replaced.
+type TOFUResolver struct {
+	resolver HostToOnionResolver
+	filename string
+	policy   TOFUPolicy
+	now      func() time.Time
+
+	mutex  sync.Mutex
+	store  TOFUStore
+	loaded os.FileInfo // file the store was read from or written to
+}
+
+// NewTOFUResolver loads the store from filename.
+// Missing file is treated as an empty store.
+func NewTOFUResolver(
+	resolver HostToOnionResolver,
+	filename string,
+	policy TOFUPolicy,
+) (*TOFUResolver, error) {
+	r := &TOFUResolver{
+		resolver: resolver,
+		filename: filename,
+		policy:   policy,
+		now:      time.Now,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the store from the file. Must be called with mutex held.
+func (r *TOFUResolver) load() error {
+	info, err := os.Stat(r.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data, err := ioutil.ReadFile(r.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var store TOFUStore
+	if err := yaml.Unmarshal(data, &store); err != nil {
+		return fmt.Errorf("Error parsing %s: %s", r.filename, err)
+	}
+	if store.Pins == nil {
+		store.Pins = make(map[string]*TOFUPin)
+	}
+	r.store = store
+	r.loaded = info
+	return nil
+}
+
+// reload reads the store again if the file was replaced since it was
+// loaded or saved. The file is always replaced by rename, so a new
+// file means a change by another process. Must be called with mutex held.
+func (r *TOFUResolver) reload() {
+	info, err := os.Stat(r.filename)
+	if err != nil || (r.loaded != nil && os.SameFile(info, r.loaded)) {
+		return
+	}
+	if err := r.load(); err != nil {
+		log.Printf("Unable to reload %s: %s", r.filename, err)
+	}
+}
+
+// writeFileAtomic replaces filename with data, so readers never see
+// a partially written file.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// save writes the store atomically. Must be called with mutex held.
+func (r *TOFUResolver) save() error {
+	data, err := yaml.Marshal(&r.store)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.filename, data); err != nil {
+		return err
+	}
+	r.loaded, err = os.Stat(r.filename)
+	return err
+}
+
+func (r *TOFUResolver) audit(host, onion, action string) {
+	r.store.History = append(r.store.History, TOFUEvent{
+		Time:   r.now(),
+		Host:   host,
+		Onion:  onion,
+		Action: action,
+	})
+	if extra := len(r.store.History) - maxTOFUHistory; extra > 0 {
+		r.store.History = append([]TOFUEvent(nil), r.store.History[extra:]...)
+	}
+}
+
+func contains(list []string, item string) bool {
+	for _, element := range list {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}
+
+// check filters targets according to the pins and the policy
+// and updates the store.
+func (r *TOFUResolver) check(host string, targets []OnionTarget) ([]OnionTarget, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reload()
+	changed := false
+	pin, ok := r.store.Pins[host]
+	if !ok {
+		pin = &TOFUPin{FirstSeen: r.now()}
+		r.store.Pins[host] = pin
+		for _, target := range targets {
+			if !contains(pin.Onions, target.Onion) {
+				pin.Onions = append(pin.Onions, target.Onion)
+				r.audit(host, target.Onion, "pinned")
+			}
+		}
+		changed = true
+	}
+	if r.policy == TOFUWarn {
+		var resolved, added []string
+		for _, target := range targets {
+			if !contains(resolved, target.Onion) {
+				resolved = append(resolved, target.Onion)
+				if !contains(pin.Onions, target.Onion) {
+					added = append(added, target.Onion)
+				}
+			}
+		}
+		if len(added) != 0 {
+			log.Printf("Warning: %s changed onion from %v to %v", host, pin.Onions, resolved)
+			for _, onion := range added {
+				r.audit(host, onion, "changed")
+			}
+			pin.Onions = resolved
+			changed = true
+		}
+	}
+	var trusted []OnionTarget
+	for _, target := range targets {
+		if contains(pin.Onions, target.Onion) {
+			trusted = append(trusted, target)
+		} else if !contains(pin.Pending, target.Onion) {
+			log.Printf("Blocked change of onion of %s from %v to %s", host, pin.Onions, target.Onion)
+			pin.Pending = append(pin.Pending, target.Onion)
+			r.audit(host, target.Onion, "blocked")
+			changed = true
+		}
+	}
+	if changed {
+		if err := r.save(); err != nil {
+			log.Printf("Unable to save %s: %s", r.filename, err)
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, newResolveError(
+			PolicyDenied,
+			"Onion of %s changed from %v, approval required",
+			host,
+			pin.Onions,
+		)
+	}
+	return trusted, nil
+}
+
+func (r *TOFUResolver) ResolveToTargets(hostname string) ([]OnionTarget, error) {
+	targets, err := ResolveTargets(r.resolver, hostname)
+	if err != nil {
+		return nil, err
+	}
+	return r.check(dns.Fqdn(hostname), targets)
+}
+
+func (r *TOFUResolver) ResolveToOnion(hostname string) (string, error) {
+	targets, err := r.ResolveToTargets(hostname)
+	if err != nil {
+		return "", err
+	}
+	return targets[0].Onion, nil
+}
+
+// Approve trusts pending onions of host instead of pinned ones.
+func (r *TOFUResolver) Approve(hostname string) error {
+	host := dns.Fqdn(hostname)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reload()
+	pin, ok := r.store.Pins[host]
+	if !ok || len(pin.Pending) == 0 {
+		return fmt.Errorf("No pending changes for %s", host)
+	}
+	for _, onion := range pin.Pending {
+		r.audit(host, onion, "approved")
+	}
+	pin.Onions = pin.Pending
+	pin.Pending = nil
+	return r.save()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type SwitchingResolver struct {
+	onion string
+}
+
+func (r *SwitchingResolver) ResolveToOnion(hostname string) (string, error) {
+	return r.onion, nil
+}
+
+func makeTOFUResolver(t *testing.T, policy TOFUPolicy) (*TOFUResolver, *SwitchingResolver, func()) {
+	dir, err := ioutil.TempDir("", "tofu")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	inner := &SwitchingResolver{"pastagdsp33j7aoq.onion"}
+	resolver, err := NewTOFUResolver(inner, filepath.Join(dir, "tofu.yaml"), policy)
+	if err != nil {
+		t.Fatalf("Failed to create TOFU resolver: %s", err)
+	}
+	return resolver, inner, func() { os.RemoveAll(dir) }
+}
+
+func TestTOFUWarn(t *testing.T) {
+	resolver, inner, cleanup := makeTOFUResolver(t, TOFUWarn)
+	defer cleanup()
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	inner.onion = "t3mny6lhnyku4wrd.onion"
+	onion, err := resolver.ResolveToOnion("pasta.cf")
+	if err != nil || onion != inner.onion {
+		t.Fatalf("Warn policy returned %q, %v", onion, err)
+	}
+	pin := resolver.store.Pins["pasta.cf."]
+	if len(pin.Onions) != 1 || pin.Onions[0] != inner.onion {
+		t.Fatalf("Expected new onion to replace the pin, got %v", pin.Onions)
+	}
+	if len(resolver.store.History) != 2 || resolver.store.History[1].Action != "changed" {
+		t.Fatalf("Unexpected history %v", resolver.store.History)
+	}
+}
+
+func TestTOFUBlockAndApprove(t *testing.T) {
+	resolver, inner, cleanup := makeTOFUResolver(t, TOFUBlock)
+	defer cleanup()
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err != nil {
+		t.Fatalf("Failed to resolve: %s", err)
+	}
+	inner.onion = "t3mny6lhnyku4wrd.onion"
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err == nil {
+		t.Fatalf("Changed onion was not blocked")
+	}
+	// the store must survive restart
+	reloaded, err := NewTOFUResolver(inner, resolver.filename, TOFUBlock)
+	if err != nil {
+		t.Fatalf("Failed to reload store: %s", err)
+	}
+	if err := reloaded.Approve("pasta.cf."); err != nil {
+		t.Fatalf("Failed to approve: %s", err)
+	}
+	onion, err := reloaded.ResolveToOnion("pasta.cf")
+	if err != nil || onion != inner.onion {
+		t.Fatalf("Approved onion resolved to %q, %v", onion, err)
+	}
+	if err := reloaded.Approve("pasta.cf"); err == nil {
+		t.Fatalf("Approved change which is not pending")
+	}
+	actions := ""
+	for _, event := range reloaded.store.History {
+		actions += event.Action + " "
+	}
+	if actions != "pinned blocked approved " {
+		t.Fatalf("Unexpected history %q", actions)
+	}
+}
+
+func TestTOFUApproveByOtherProcess(t *testing.T) {
+	resolver, inner, cleanup := makeTOFUResolver(t, TOFUBlock)
+	defer cleanup()
+	resolver.ResolveToOnion("pasta.cf")
+	resolver.ResolveToOnion("www.pasta.cf")
+	inner.onion = "t3mny6lhnyku4wrd.onion"
+	if _, err := resolver.ResolveToOnion("pasta.cf"); err == nil {
+		t.Fatalf("Changed onion was not blocked")
+	}
+	// -tofu-approve runs in another process
+	approver, err := NewTOFUResolver(nil, resolver.filename, TOFUBlock)
+	if err != nil {
+		t.Fatalf("Failed to load store: %s", err)
+	}
+	if err := approver.Approve("pasta.cf"); err != nil {
+		t.Fatalf("Failed to approve: %s", err)
+	}
+	onion, err := resolver.ResolveToOnion("pasta.cf")
+	if err != nil || onion != inner.onion {
+		t.Fatalf("Approved onion resolved to %q, %v", onion, err)
+	}
+	// saving the store must not undo the approval
+	if _, err := resolver.ResolveToOnion("www.pasta.cf"); err == nil {
+		t.Fatalf("Changed onion was not blocked")
+	}
+	reloaded, err := NewTOFUResolver(inner, resolver.filename, TOFUBlock)
+	if err != nil {
+		t.Fatalf("Failed to load store: %s", err)
+	}
+	if pin := reloaded.store.Pins["pasta.cf."]; len(pin.Onions) != 1 || pin.Onions[0] != inner.onion {
+		t.Fatalf("Approval was undone, pin is %v", pin)
+	}
+}
+
+func TestTOFUHistoryLimit(t *testing.T) {
+	resolver, _, cleanup := makeTOFUResolver(t, TOFUWarn)
+	defer cleanup()
+	for i := 0; i < maxTOFUHistory+10; i++ {
+		resolver.audit("pasta.cf.", "pastagdsp33j7aoq.onion", fmt.Sprintf("event %d", i))
+	}
+	history := resolver.store.History
+	if len(history) != maxTOFUHistory || history[0].Action != "event 10" {
+		t.Fatalf("Got %d events starting with %v", len(history), history[0])
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+/*  Generates TXT record binding a domain to an onion service
+
+The record is signed with the identity key of v3 onion service
+and can be verified by entry_proxy using the key embedded in the
+onion address.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DonnchaC/oniongateway/util"
+)
+
+var (
+	keyFile = flag.String(
+		"key",
+		"",
+		"hs_ed25519_secret_key file of the onion service",
+	)
+	domain = flag.String(
+		"domain",
+		"",
+		"Domain to bind to the onion service",
+	)
+	validFor = flag.Duration(
+		"valid-for",
+		30*24*time.Hour,
+		"Validity period of the binding",
+	)
+)
+
+func main() {
+	flag.Parse()
+	if *keyFile == "" || *domain == "" {
+		fmt.Printf("Options -key and -domain are required\n")
+		os.Exit(1)
+	}
+	key, err := util.ReadOnionSecretKey(*keyFile)
+	if err != nil {
+		fmt.Printf("Error reading key %s: %s\n", *keyFile, err)
+		os.Exit(1)
+	}
+	expires := time.Now().Add(*validFor)
+	record := key.SignBinding(*domain, expires)
+	fmt.Printf("%s. IN TXT %q\n", strings.TrimSuffix(*domain, "."), record)
+}
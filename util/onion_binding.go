@@ -0,0 +1,184 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	onionV3Version  = 3
+	onionV3Length   = 56
+	torKeyHeader    = "== ed25519v1-secret: type0 ==\x00\x00\x00"
+	bindingContext  = "oniongateway-binding-v1"
+	expandedKeySize = 64
+)
+
+var onionEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func onionChecksum(publicKey []byte) []byte {
+	hash := sha3.New256()
+	hash.Write([]byte(".onion checksum"))
+	hash.Write(publicKey)
+	hash.Write([]byte{onionV3Version})
+	return hash.Sum(nil)[:2]
+}
+
+// OnionAddressFromPublicKey returns v3 onion address (with ".onion")
+// of the onion service with given ed25519 identity key.
+func OnionAddressFromPublicKey(publicKey ed25519.PublicKey) string {
+	var raw []byte
+	raw = append(raw, publicKey...)
+	raw = append(raw, onionChecksum(publicKey)...)
+	raw = append(raw, onionV3Version)
+	return strings.ToLower(onionEncoding.EncodeToString(raw)) + ".onion"
+}
+
+// PublicKeyFromOnionAddress extracts ed25519 identity key from
+// v3 onion address. The checksum and version are verified.
+func PublicKeyFromOnionAddress(onion string) (ed25519.PublicKey, error) {
+	label := strings.TrimSuffix(strings.ToLower(onion), ".onion")
+	if len(label) != onionV3Length {
+		return nil, fmt.Errorf("%q is not a v3 onion address", onion)
+	}
+	raw, err := onionEncoding.DecodeString(strings.ToUpper(label))
+	if err != nil {
+		return nil, fmt.Errorf("Bad base32 in onion address %q: %s", onion, err)
+	}
+	publicKey := raw[:ed25519.PublicKeySize]
+	checksum := raw[ed25519.PublicKeySize : ed25519.PublicKeySize+2]
+	version := raw[ed25519.PublicKeySize+2]
+	if version != onionV3Version {
+		return nil, fmt.Errorf("Unknown version %d of onion address %q", version, onion)
+	}
+	if !bytes.Equal(checksum, onionChecksum(publicKey)) {
+		return nil, fmt.Errorf("Bad checksum of onion address %q", onion)
+	}
+	return ed25519.PublicKey(publicKey), nil
+}
+
+// BindingMessage returns the message signed to bind domain to onion
+// until expiry. Domain is compared without trailing dot and case.
+func BindingMessage(domain, onion string, expires time.Time) []byte {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	onion = strings.ToLower(onion)
+	return []byte(strings.Join([]string{
+		bindingContext,
+		domain,
+		onion,
+		strconv.FormatInt(expires.Unix(), 10),
+	}, "\x00"))
+}
+
+// VerifyBinding checks base64 signature of binding of domain to onion
+// made with the identity key of the onion service.
+func VerifyBinding(domain, onion string, expires time.Time, signature string, now time.Time) error {
+	if !now.Before(expires) {
+		return fmt.Errorf("Binding of %s to %s expired at %s", domain, onion, expires)
+	}
+	publicKey, err := PublicKeyFromOnionAddress(onion)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("Bad base64 in signature: %s", err)
+	}
+	if !ed25519.Verify(publicKey, BindingMessage(domain, onion, expires), sig) {
+		return fmt.Errorf("Bad signature of binding of %s to %s", domain, onion)
+	}
+	return nil
+}
+
+// OnionSecretKey is expanded ed25519 secret key as stored by Tor
+// in hs_ed25519_secret_key: clamped scalar followed by hash prefix.
+type OnionSecretKey [expandedKeySize]byte
+
+// ReadOnionSecretKey reads hs_ed25519_secret_key file of Tor.
+func ReadOnionSecretKey(filename string) (*OnionSecretKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != len(torKeyHeader)+expandedKeySize ||
+		!bytes.HasPrefix(data, []byte(torKeyHeader)) {
+		return nil, fmt.Errorf("%s is not a Tor ed25519 secret key file", filename)
+	}
+	var key OnionSecretKey
+	copy(key[:], data[len(torKeyHeader):])
+	return &key, nil
+}
+
+// NewOnionSecretKey expands ed25519 private key into
+// the form used by Tor.
+func NewOnionSecretKey(privateKey ed25519.PrivateKey) *OnionSecretKey {
+	digest := sha512.Sum512(privateKey.Seed())
+	digest[0] &= 248
+	digest[31] &= 127
+	digest[31] |= 64
+	key := OnionSecretKey(digest)
+	return &key
+}
+
+func (k *OnionSecretKey) scalar() *edwards25519.Scalar {
+	scalar, err := edwards25519.NewScalar().SetBytesWithClamping(k[:32])
+	if err != nil {
+		panic(err)
+	}
+	return scalar
+}
+
+// PublicKey returns ed25519 identity key of the onion service.
+func (k *OnionSecretKey) PublicKey() ed25519.PublicKey {
+	point := edwards25519.NewIdentityPoint().ScalarBaseMult(k.scalar())
+	return ed25519.PublicKey(point.Bytes())
+}
+
+// Sign makes ed25519 signature of message.
+func (k *OnionSecretKey) Sign(message []byte) []byte {
+	publicKey := k.PublicKey()
+
+	hash := sha512.New()
+	hash.Write(k[32:])
+	hash.Write(message)
+	r, err := edwards25519.NewScalar().SetUniformBytes(hash.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	R := edwards25519.NewIdentityPoint().ScalarBaseMult(r)
+
+	hash.Reset()
+	hash.Write(R.Bytes())
+	hash.Write(publicKey)
+	hash.Write(message)
+	h, err := edwards25519.NewScalar().SetUniformBytes(hash.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	S := edwards25519.NewScalar().MultiplyAdd(h, k.scalar(), r)
+
+	return append(R.Bytes(), S.Bytes()...)
+}
+
+// SignBinding returns TXT record binding domain to the onion service
+// of the key until expiry.
+func (k *OnionSecretKey) SignBinding(domain string, expires time.Time) string {
+	onion := OnionAddressFromPublicKey(k.PublicKey())
+	signature := k.Sign(BindingMessage(domain, onion, expires))
+	return fmt.Sprintf(
+		"onion=%s expires=%d sig=%s",
+		onion,
+		expires.Unix(),
+		base64.StdEncoding.EncodeToString(signature),
+	)
+}
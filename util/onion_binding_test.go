@@ -0,0 +1,119 @@
+package util
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func makeOnionSecretKey(t *testing.T) (*OnionSecretKey, ed25519.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	return NewOnionSecretKey(privateKey), publicKey
+}
+
+func TestOnionAddressRoundTrip(t *testing.T) {
+	key, publicKey := makeOnionSecretKey(t)
+	if string(key.PublicKey()) != string(publicKey) {
+		t.Fatalf("Expanded key has wrong public key")
+	}
+	onion := OnionAddressFromPublicKey(publicKey)
+	if len(onion) != 62 || !strings.HasSuffix(onion, ".onion") {
+		t.Fatalf("Bad onion address %q", onion)
+	}
+	decoded, err := PublicKeyFromOnionAddress(onion)
+	if err != nil {
+		t.Fatalf("Failed to decode %q: %s", onion, err)
+	}
+	if string(decoded) != string(publicKey) {
+		t.Fatalf("Decoded wrong public key from %q", onion)
+	}
+	// break the checksum
+	broken := []byte(onion)
+	broken[53] = 'a' + (broken[53]-'a'+1)%26
+	if _, err := PublicKeyFromOnionAddress(string(broken)); err == nil {
+		t.Fatalf("Onion address with bad checksum %q was accepted", broken)
+	}
+	if _, err := PublicKeyFromOnionAddress("pastagdsp33j7aoq.onion"); err == nil {
+		t.Fatalf("v2 onion address was accepted")
+	}
+}
+
+func TestSignMatchesEd25519(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	message := []byte("test message")
+	signature := NewOnionSecretKey(privateKey).Sign(message)
+	if string(signature) != string(ed25519.Sign(privateKey, message)) {
+		t.Fatalf("Signature differs from ed25519.Sign")
+	}
+	if !ed25519.Verify(publicKey, message, signature) {
+		t.Fatalf("Signature is not valid")
+	}
+}
+
+func parseBinding(record string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(record) {
+		parts := strings.SplitN(field, "=", 2)
+		fields[parts[0]] = parts[1]
+	}
+	return fields
+}
+
+func TestVerifyBinding(t *testing.T) {
+	key, _ := makeOnionSecretKey(t)
+	now := time.Unix(1500000000, 0)
+	expires := now.Add(time.Hour)
+	fields := parseBinding(key.SignBinding("Example.com.", expires))
+	onion, sig := fields["onion"], fields["sig"]
+	if err := VerifyBinding("example.com", onion, expires, sig, now); err != nil {
+		t.Fatalf("Valid binding was rejected: %s", err)
+	}
+	if err := VerifyBinding("example.org", onion, expires, sig, now); err == nil {
+		t.Fatalf("Binding for other domain was accepted")
+	}
+	if err := VerifyBinding("example.com", onion, expires.Add(time.Hour), sig, now); err == nil {
+		t.Fatalf("Binding with changed expiry was accepted")
+	}
+	if err := VerifyBinding("example.com", onion, expires, sig, expires); err == nil {
+		t.Fatalf("Expired binding was accepted")
+	}
+	other, _ := makeOnionSecretKey(t)
+	otherOnion := OnionAddressFromPublicKey(other.PublicKey())
+	if err := VerifyBinding("example.com", otherOnion, expires, sig, now); err == nil {
+		t.Fatalf("Binding for other onion was accepted")
+	}
+}
+
+func TestReadOnionSecretKey(t *testing.T) {
+	key, publicKey := makeOnionSecretKey(t)
+	file, err := ioutil.TempFile("", "hs_ed25519_secret_key")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %s", err)
+	}
+	defer os.Remove(file.Name())
+	file.Write([]byte(torKeyHeader))
+	file.Write(key[:])
+	file.Close()
+	loaded, err := ReadOnionSecretKey(file.Name())
+	if err != nil {
+		t.Fatalf("Failed to read key: %s", err)
+	}
+	if string(loaded.PublicKey()) != string(publicKey) {
+		t.Fatalf("Loaded key has wrong public key")
+	}
+	ioutil.WriteFile(file.Name(), key[:], 0600)
+	if _, err := ReadOnionSecretKey(file.Name()); err == nil {
+		t.Fatalf("Key file without header was accepted")
+	}
+}